@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	authCookie = "gone_auth"
+	authTTL    = 10 * time.Minute
+)
+
+// authAttempt is a sign-in started by an admin, the callback must present its state and the cookie set with it
+type authAttempt struct {
+	mount    *mount
+	verifier string
+	expires  time.Time
+}
+
+var authAttempts = struct {
+	sync.Mutex
+	m map[string]*authAttempt
+}{m: map[string]*authAttempt{}}
+
+func randomString(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func setAuthCookie(w http.ResponseWriter, r *http.Request, value string, expire time.Time) {
+	// the callback is a cross-site redirect from the login page, so Strict cookies like the session are not sent
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expire,
+		HttpOnly: true,
+		Secure:   secureCookie(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// StartAuth sends the admin to sign in the drive of m, with a fresh state and PKCE verifier
+func StartAuth(w http.ResponseWriter, r *http.Request, m *mount) {
+	state, verifier := randomString(24), randomString(48)
+	now := time.Now()
+
+	authAttempts.Lock()
+	for k, a := range authAttempts.m {
+		if now.After(a.expires) {
+			delete(authAttempts.m, k)
+		}
+	}
+	authAttempts.m[state] = &authAttempt{mount: m, verifier: verifier, expires: now.Add(authTTL)}
+	authAttempts.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	setAuthCookie(w, r, state, now.Add(authTTL))
+	http.Redirect(w, r, m.one.AuthorizeURL(state, base64.RawURLEncoding.EncodeToString(challenge[:])), http.StatusTemporaryRedirect)
+}
+
+func writeAuthError(w http.ResponseWriter, msg string) {
+	w.WriteHeader(http.StatusBadRequest)
+	writeError(w, "Sign-in failed: "+template.HTMLEscapeString(msg))
+}
+
+// AuthCallback finishes a sign-in started by StartAuth in the same browser
+func AuthCallback(w http.ResponseWriter, r *http.Request) {
+	state := r.FormValue("state")
+
+	authAttempts.Lock()
+	a := authAttempts.m[state]
+	delete(authAttempts.m, state)
+	authAttempts.Unlock()
+
+	c, _ := r.Cookie(authCookie)
+	setAuthCookie(w, r, "", time.Unix(0, 0))
+
+	if a == nil || time.Now().After(a.expires) {
+		log.Println("Sign-in rejected: unknown or expired state")
+		writeAuthError(w, "This sign-in is unknown or has expired")
+		return
+	}
+	if c == nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		log.Println("Sign-in rejected: state doesn't match the browser")
+		writeAuthError(w, "This sign-in was not started in this browser")
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		writeAuthError(w, e+": "+r.FormValue("error_description"))
+		return
+	}
+
+	a.mount.one.GetTokenCallback(w, r, a.verifier)
+}
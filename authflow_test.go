@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuthCallback(t *testing.T) {
+	e := newTestEnv(t, nil)
+	defer e.Close()
+
+	// only the admin may start a sign-in
+	resp, _ := e.get(t, e.client(false), "/?auth", nil)
+	if resp.Request.URL.RawQuery != "login" {
+		t.Fatalf("a visitor starting a sign-in ended at %s, want the login page", resp.Request.URL)
+	}
+
+	resp, _ = e.get(t, e.client(false), "/callback?code=fake-code&state=unknown", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %s for an unknown state, want 400", resp.Status)
+	}
+
+	// the callback of a sign-in started in another browser is rejected, and the attempt is used up
+	admin := e.client(true)
+	admin.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if strings.HasPrefix(req.URL.String(), e.srv.URL+"/callback") {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	resp, _ = e.get(t, admin, "/?auth", nil)
+	callback := resp.Header.Get("Location")
+	if !strings.HasPrefix(callback, e.srv.URL+"/callback?") || !strings.Contains(callback, "state=") {
+		t.Fatalf("the fake redirected to %q, want the callback with a state", callback)
+	}
+	resp, body := e.get(t, e.client(false), strings.TrimPrefix(callback, e.srv.URL), nil)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "not started in this browser") {
+		t.Fatalf("got %s for a callback without the auth cookie, want 400", resp.Status)
+	}
+	resp, _ = e.get(t, admin, strings.TrimPrefix(callback, e.srv.URL), nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %s for a used state, want 400", resp.Status)
+	}
+	if e.m.one.tokens.Tokens().Refresh != "" {
+		t.Fatal("a rejected callback has signed in")
+	}
+
+	e.signIn(t)
+	tk := e.m.one.tokens.Tokens()
+	if tk.Public || !strings.HasPrefix(tk.Refresh, "refresh-") {
+		t.Fatalf("got tokens %+v after the callback", tk)
+	}
+}
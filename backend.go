@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backend is where the index reads its items from, all paths start with /.
+// Open may ignore the Range in h and answer with the whole content.
+// Calls to the remote end are cancelled along with ctx.
+type Backend interface {
+	List(ctx context.Context, path string) *driveItems
+	Stat(ctx context.Context, path string) (*driveItem, error)
+	Open(ctx context.Context, item *driveItem, h http.Header) (*http.Response, error)
+	DownloadURL(item *driveItem) string
+	Thumbnail(ctx context.Context, item *driveItem, size string) (string, error)
+	Search(ctx context.Context, path, q string) *driveItems
+}
+
+// localFiler is implemented by backends whose items are plain files on this machine,
+// serveFile hands them to http.ServeFile instead of going through the prefetch cache
+type localFiler interface {
+	LocalPath(item *driveItem) string
+}
+
+type localBackend struct {
+	root string
+}
+
+func newLocalBackend(root string) *localBackend {
+	return &localBackend{root: filepath.Clean(root)}
+}
+
+func (l *localBackend) abs(path string) string {
+	return filepath.Join(l.root, filepath.FromSlash(filepath.Clean("/"+path)))
+}
+
+func (l *localBackend) item(dir string, info os.FileInfo) *driveItem {
+	ts := info.ModTime().UTC().Format(time.RFC3339)
+	item := &driveItem{
+		ID:                   strings.TrimSuffix(dir, "/") + "/" + info.Name(),
+		Name:                 info.Name(),
+		CreatedDateTime:      ts,
+		LastModifiedDateTime: ts,
+	}
+	item.FileSystemInfo.CreatedDateTime = ts
+	item.FileSystemInfo.LastModifiedDateTime = ts
+	item.ParentReference.Path = dir
+	item.ETag = fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+
+	if info.IsDir() {
+		children, _ := ioutil.ReadDir(l.abs(item.ID))
+		item.Folder = &_folder{ChildCount: len(children)}
+	} else {
+		item.Size = int(info.Size())
+	}
+	return item
+}
+
+func (l *localBackend) List(ctx context.Context, path string) (x *driveItems) {
+	x = &driveItems{}
+	infos, err := ioutil.ReadDir(l.abs(path))
+	if err != nil {
+		x.Error.Message = err.Error()
+		return
+	}
+
+	for _, info := range infos {
+		x.Values = append(x.Values, l.item(path, info))
+	}
+	x.ts = time.Now().Unix()
+	return
+}
+
+func (l *localBackend) Stat(ctx context.Context, path string) (*driveItem, error) {
+	info, err := os.Stat(l.abs(path))
+	if err != nil {
+		return nil, err
+	}
+	path = strings.TrimSuffix(path, "/")
+	if path == "" {
+		children, _ := ioutil.ReadDir(l.root)
+		item := l.item("", info)
+		item.ID, item.Name = "/", ""
+		item.Folder = &_folder{ChildCount: len(children)}
+		return item, nil
+	}
+	return l.item(path[:strings.LastIndex(path, "/")+1], info), nil
+}
+
+func (l *localBackend) LocalPath(item *driveItem) string {
+	return l.abs(item.ID)
+}
+
+func (l *localBackend) Open(ctx context.Context, item *driveItem, h http.Header) (*http.Response, error) {
+	f, err := os.Open(l.LocalPath(item))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       f,
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(item.Size))
+	resp.Header.Set("Accept-Ranges", "bytes")
+	if ct := mime.TypeByExtension(filepath.Ext(item.Name)); ct != "" {
+		resp.Header.Set("Content-Type", ct)
+	}
+	return resp, nil
+}
+
+func (l *localBackend) DownloadURL(item *driveItem) string {
+	return "?file=" + url.QueryEscape(item.Name)
+}
+
+func (l *localBackend) Thumbnail(ctx context.Context, item *driveItem, size string) (string, error) {
+	return "", fmt.Errorf("thumbnails are not supported by the local backend")
+}
+
+func (l *localBackend) Search(ctx context.Context, path, q string) (x *driveItems) {
+	x = &driveItems{}
+	q = strings.ToLower(q)
+	root := l.abs(path)
+	err := filepath.Walk(root, func(fp string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || fp == root {
+			return nil
+		}
+		if !strings.Contains(strings.ToLower(info.Name()), q) {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(l.root, filepath.Dir(fp))
+		dir := filepath.ToSlash(filepath.Clean("/" + rel))
+		x.Values = append(x.Values, l.item(dir, info))
+		return nil
+	})
+	if err != nil {
+		x.Error.Message = err.Error()
+	}
+	x.ts = time.Now().Unix()
+	return
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cacheKeyLen is the length of "<hash>.<version>-" in front of the file name of a cached file
+const cacheKeyLen = 36 + 1 + 8 + 1
+
+// cachePath keys the prefetch cache on the drive and item ID,
+// the version part changes whenever the item's eTag does
+func cachePath(item *driveItem) string {
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(item.ParentReference.DriveID+"/"+item.ID)))
+	ver := item.ETag
+	if ver == "" {
+		ver = item.LastModifiedDateTime
+	}
+	ver = fmt.Sprintf("%x", sha1.Sum([]byte(ver)))
+	return "cache/" + hash[:2] + "/" + hash[2:4] + "/" + hash[4:] + "." + ver[:8] + "-" + item.Name
+}
+
+// prefetchTimeout bounds a download into the prefetch cache, which goes on after its client has left
+const prefetchTimeout = 30 * time.Minute
+
+// download is an upstream fetch into the prefetch cache, concurrent misses of the same file wait on it
+type download struct {
+	done chan struct{}
+	ok   bool
+}
+
+var downloads = struct {
+	sync.Mutex
+	m map[string]*download
+}{m: map[string]*download{}}
+
+// startDownload returns the download in flight for cachepath, leader is true if the caller should do it
+func startDownload(cachepath string) (d *download, leader bool) {
+	downloads.Lock()
+	defer downloads.Unlock()
+	if d = downloads.m[cachepath]; d != nil {
+		return d, false
+	}
+	d = &download{done: make(chan struct{})}
+	downloads.m[cachepath] = d
+	return d, true
+}
+
+func (d *download) finish(cachepath string) {
+	downloads.Lock()
+	delete(downloads.m, cachepath)
+	downloads.Unlock()
+	close(d.done)
+}
+
+// clientWriter writes to the client until the first error, after that the
+// download goes on for the cache only
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	if c.err == nil {
+		_, c.err = c.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// fill streams body to the client and a temp file, the temp file is renamed
+// to cachepath only when it is complete and exactly size bytes long
+func (d *download) fill(w io.Writer, body io.Reader, cachepath string, size int64) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(cachepath), ".tmp-")
+	if err != nil {
+		io.Copy(w, body)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(io.MultiWriter(tmp, &clientWriter{w: w}), body)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("got %d bytes, expected %d", n, size)
+	}
+
+	if err := os.Rename(tmp.Name(), cachepath); err != nil {
+		return err
+	}
+	prefetch.AddWeight(cachepath, true, n)
+	d.ok = true
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type cloud struct {
+	login, graph string
+}
+
+// clouds are the presets of Cloud, see https://learn.microsoft.com/graph/deployments
+var clouds = map[string]cloud{
+	"global":    {"login.microsoftonline.com", "graph.microsoft.com"},
+	"china":     {"login.chinacloudapi.cn", "microsoftgraph.chinacloudapi.cn"},
+	"usgov":     {"login.microsoftonline.us", "graph.microsoft.us"},
+	"usgov-dod": {"login.microsoftonline.us", "dod-graph.microsoft.us"},
+}
+
+func hostURL(host string) string {
+	host = strings.TrimSuffix(host, "/")
+	if strings.Contains(host, "://") {
+		return host
+	}
+	return "https://" + host
+}
+
+// resolveEndpoints fills GraphURL and LoginURL from Cloud, Tenant, AuthorityHost and GraphHost,
+// URLs given in the config are kept as they are
+func (c *config) resolveEndpoints() error {
+	name := strings.ToLower(c.Cloud)
+	if name == "" {
+		name = "global"
+	}
+	preset, ok := clouds[name]
+	if !ok {
+		return fmt.Errorf("Unknown cloud: %s", c.Cloud)
+	}
+
+	if c.AuthorityHost == "" {
+		c.AuthorityHost = preset.login
+	}
+	if c.GraphHost == "" {
+		c.GraphHost = preset.graph
+	}
+	if c.Tenant == "" {
+		c.Tenant = "common"
+	}
+
+	if c.GraphURL == "" {
+		c.GraphURL = hostURL(c.GraphHost) + "/v1.0"
+	}
+	if c.LoginURL == "" {
+		c.LoginURL = hostURL(c.AuthorityHost) + "/" + c.Tenant + "/oauth2/v2.0"
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// loadClientCertificate reads the certificate and its RSA private key from a PEM file
+func loadClientCertificate(path string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cert *x509.Certificate
+	var key *rsa.PrivateKey
+	for {
+		var block *pem.Block
+		if block, buf = pem.Decode(buf); block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			if cert == nil {
+				cert, err = x509.ParseCertificate(block.Bytes)
+			}
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			var k interface{}
+			if k, err = x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+				var ok bool
+				if key, ok = k.(*rsa.PrivateKey); !ok {
+					err = fmt.Errorf("the private key must be RSA")
+				}
+			}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if cert == nil || key == nil {
+		return nil, nil, fmt.Errorf("%s must contain a certificate and its private key", path)
+	}
+	return cert, key, nil
+}
+
+func base64URL(buf []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// clientAssertion signs a JWT that proves the app owns the certificate, see
+// https://learn.microsoft.com/entra/identity-platform/certificate-credentials
+func (o *oneManager) clientAssertion() (string, error) {
+	s1, s256 := sha1.Sum(o.conf.clientCert.Raw), sha256.Sum256(o.conf.clientCert.Raw)
+	header, _ := json.Marshal(map[string]string{
+		"alg":      "RS256",
+		"typ":      "JWT",
+		"x5t":      base64URL(s1[:]),
+		"x5t#S256": base64URL(s256[:]),
+	})
+
+	jti := make([]byte, 16)
+	rand.Read(jti)
+	now := time.Now().Unix()
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": o.conf.LoginURL + "/token",
+		"iss": o.client.id,
+		"sub": o.client.id,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now,
+		"iat": now,
+		"exp": now + 600,
+	})
+
+	data := base64URL(header) + "." + base64URL(claims)
+	digest := sha256.Sum256([]byte(data))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, o.conf.clientKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return data + "." + base64URL(sig), nil
+}
+
+// authenticate adds the client secret, or an assertion signed by the client certificate, to a token request
+func (o *oneManager) authenticate(form url.Values) error {
+	if o.conf.clientKey == nil {
+		form.Add("client_secret", o.client.secret)
+		return nil
+	}
+
+	assertion, err := o.clientAssertion()
+	if err != nil {
+		return err
+	}
+	form.Add("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	form.Add("client_assertion", assertion)
+	return nil
+}
+
+// ClientCredentials gets an app-only token, which needs no sign-in and comes without a refresh token
+func (o *oneManager) ClientCredentials(ctx context.Context, _ tokens) (*tokens, error) {
+	form := url.Values{}
+	form.Add("client_id", o.client.id)
+	form.Add("scope", hostURL(o.conf.GraphHost)+"/.default")
+	form.Add("grant_type", "client_credentials")
+	if err := o.authenticate(form); err != nil {
+		return nil, err
+	}
+
+	req, _ := http.NewRequest("POST", o.conf.LoginURL+"/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	buf, _ := ioutil.ReadAll(resp.Body)
+	t := parseToken(buf)
+	if t.Access == "" {
+		return nil, fmt.Errorf("failed to get app-only token: %s", resp.Status)
+	}
+	return t, nil
+}
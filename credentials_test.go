@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key as one PEM file to path
+func writeCertificate(t *testing.T, path string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gone-test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	cert := filepath.Join(os.TempDir(), "gone-test-cert.pem")
+	writeCertificate(t, cert)
+	defer os.Remove(cert)
+
+	for _, secret := range []bool{true, false} {
+		e := newTestEnv(t, func(c *config) {
+			c.AuthMode, c.Tenant, c.UserID = "app", "contoso.onmicrosoft.com", "user@contoso.onmicrosoft.com"
+			if !secret {
+				c.ClientSecret, c.ClientCertificate = "", cert
+			}
+		})
+
+		// no one signs in, the app gets its own token
+		x := e.m.backend.List(context.Background(), "/docs/")
+		if x.Error.Message != "" || len(x.Values) != 1 {
+			t.Fatalf("got %d items and %q with an app-only token", len(x.Values), x.Error.Message)
+		}
+		if tk := e.m.one.tokens.Tokens(); !strings.HasPrefix(tk.Access, "app-") || tk.Refresh != "" {
+			t.Fatalf("got tokens %+v, want an app-only token", tk)
+		}
+
+		if !secret {
+			// the assertion is signed by the certificate's key
+			assertion, err := e.m.one.clientAssertion()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts := strings.Split(assertion, ".")
+			sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			pub := conf.clientCert.PublicKey.(*rsa.PublicKey)
+			if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+				t.Fatal("the client assertion does not verify:", err)
+			}
+		}
+		e.Close()
+	}
+}
+
+func TestClientCredentialsCheck(t *testing.T) {
+	for _, c := range []*config{
+		{ClientID: "id", ClientSecret: "s", AuthMode: "app", UserID: "u"},
+		{ClientID: "id", ClientSecret: "s", AuthMode: "app", Tenant: "organizations", UserID: "u"},
+		{ClientID: "id", ClientSecret: "s", AuthMode: "app", Tenant: "contoso"},
+		{ClientID: "id", AuthMode: "app", Tenant: "contoso", UserID: "u"},
+	} {
+		if err := c.check(); err == nil {
+			t.Errorf("%+v has passed the check", c)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
 	"net/url"
 	"regexp"
 )
@@ -11,7 +13,9 @@ type _folder struct {
 
 type driveItem struct {
 	isHidden             bool
+	href                 string
 	DownloadURL          string `json:"@microsoft.graph.downloadUrl"`
+	ETag                 string `json:"eTag"`
 	CreatedDateTime      string `json:"createdDateTime"`
 	ID                   string `json:"id"`
 	LastModifiedDateTime string `json:"lastModifiedDateTime"`
@@ -40,35 +44,90 @@ type driveItem struct {
 		CreatedDateTime      string `json:"createdDateTime"`
 		LastModifiedDateTime string `json:"lastModifiedDateTime"`
 	} `json:"fileSystemInfo"`
-	Folder *_folder `json:"folder"`
+	Folder     *_folder   `json:"folder"`
+	RemoteItem *driveItem `json:"remoteItem"`
+	Deleted    *struct{}  `json:"deleted"`
+}
+
+type graphError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 type driveItems struct {
-	ts int64
+	ts      int64
+	warning string
+
+	Values   []*driveItem `json:"value"`
+	NextLink string       `json:"@odata.nextLink"`
+	Error    graphError   `json:"error"`
+}
+
+type listItem struct {
+	Name                 string `json:"name"`
+	Folder               bool   `json:"folder"`
+	Size                 int    `json:"size"`
+	ChildCount           int    `json:"childCount"`
+	CreatedDateTime      string `json:"createdDateTime"`
+	LastModifiedDateTime string `json:"lastModifiedDateTime"`
+	Href                 string `json:"href"`
+	Hidden               bool   `json:"hidden"`
+}
 
-	Values []*driveItem `json:"value"`
-	Error  struct {
-		Code    string `json:"code"`
-		Message string `json:"message"`
-	} `json:"error"`
+type listing struct {
+	Path    string     `json:"path"`
+	Query   string     `json:"query,omitempty"`
+	Warning string     `json:"warning,omitempty"`
+	Items   []listItem `json:"items"`
 }
 
 type config struct {
-	ClientID      string
-	ClientSecret  string
-	RedirURL      string
-	redir         *url.URL
-	Password      string
-	Header        string
-	Footer        string
-	Ignore        string
-	ignoreRegex   *regexp.Regexp
-	Prefetch      string
-	prefetchRegex *regexp.Regexp
-	Favicon       string
-	TopBackRedir  string
-	DisableReadme bool
-	CacheSize     int
-	CacheTTL      int
-	PrefetchSize  int
+	Mount             string
+	Drives            []*config
+	Backend           string
+	LocalRoot         string
+	DriveID           string
+	SiteID            string
+	RootPath          string
+	SharedWithMe      bool
+	AuthMode          string
+	ClientID          string
+	ClientSecret      string
+	ClientCertificate string
+	clientCert        *x509.Certificate
+	clientKey         *rsa.PrivateKey
+	UserID            string
+	Scopes            []string
+	RedirURL          string
+	TokenFile         string
+	TokenKey          string
+	redir             *url.URL
+	Password          string
+	SessionSecret     string
+	Header            string
+	Footer            string
+	Ignore            string
+	ignoreRegex       *regexp.Regexp
+	Prefetch          string
+	prefetchRegex     *regexp.Regexp
+	Favicon           string
+	TopBackRedir      string
+	DisableReadme     bool
+	CacheSize         int
+	CacheTTL          int
+	CacheDir          string
+	PrefetchSize      int
+	PageSize          int
+	IndexFile         string
+	IndexInterval     int
+	DeltaInterval     int
+	NotifyURL         string
+	notify            *url.URL
+	Cloud             string
+	Tenant            string
+	AuthorityHost     string
+	GraphHost         string
+	GraphURL          string
+	LoginURL          string
+	WebDAVPrefix      string
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type deltaPage struct {
+	Values    []*driveItem `json:"value"`
+	NextLink  string       `json:"@odata.nextLink"`
+	DeltaLink string       `json:"@odata.deltaLink"`
+	Error     graphError   `json:"error"`
+}
+
+// folderIndex remembers which listing path belongs to which folder ID, delta results only carry IDs
+type folderIndex struct {
+	mu    sync.Mutex
+	paths map[string]string
+}
+
+// note records the folders seen in the listing of path
+func (f *folderIndex) note(path string, values []*driveItem) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paths == nil {
+		f.paths = map[string]string{}
+	}
+	for _, v := range values {
+		if v.ParentReference.ID != "" {
+			f.paths[v.ParentReference.ID] = path
+		}
+		if v.Folder != nil {
+			f.paths[v.ID] = path + v.Name + "/"
+		}
+	}
+}
+
+// deltaPoller follows the changes of a drive and drops the cached listings they affect,
+// the delta link is kept in a file so changes made while gone was down are not missed
+type deltaPoller struct {
+	o        *oneManager
+	file     string
+	interval time.Duration
+	link     string
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newDeltaPoller(o *oneManager) *deltaPoller {
+	d := &deltaPoller{
+		o:        o,
+		file:     o.conf.TokenFile + ".delta",
+		interval: time.Duration(o.conf.DeltaInterval) * time.Second,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if d.interval <= 0 {
+		d.interval = deltaFallback
+	}
+	if buf, err := ioutil.ReadFile(d.file); err == nil {
+		d.link = strings.TrimSpace(string(buf))
+	}
+	go d.run()
+	return d
+}
+
+func (d *deltaPoller) run() {
+	defer close(d.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-d.stop
+		cancel()
+	}()
+
+	for {
+		wait := d.interval
+		if err := d.sync(ctx); err == errNotSignedIn {
+			// start from the changes after the admin signs in
+			wait = 10 * time.Second
+		} else if err != nil && ctx.Err() == nil {
+			log.Println("Delta:", err)
+		}
+		select {
+		case <-time.After(wait):
+		case <-d.wake:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// poke makes the poller sync now, notifications arriving during a sync cause one more
+func (d *deltaPoller) poke() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sync reads the changes since the last delta link, the first sync only asks for a link to start from
+func (d *deltaPoller) sync(ctx context.Context) error {
+	link := d.link
+	if link == "" {
+		link = d.o.driveRoot() + "/root/delta?token=latest"
+	}
+
+	changes := 0
+	for link != "" {
+		page := &deltaPage{}
+		if err := d.o.getJSON(ctx, link, page, &page.Error); err != nil {
+			if page.Error.Code == "resyncRequired" {
+				// the link is too old, everything cached may be stale
+				log.Println("Delta: resync required, clearing the cache")
+				d.o.invalidateAll()
+				d.save("")
+			}
+			return err
+		}
+
+		for _, v := range page.Values {
+			d.o.invalidate(v)
+		}
+		changes += len(page.Values)
+
+		if page.DeltaLink != "" {
+			d.save(page.DeltaLink)
+		}
+		link = page.NextLink
+	}
+
+	if changes > 0 {
+		log.Println("Delta:", changes, "changes")
+	}
+	return nil
+}
+
+func (d *deltaPoller) save(link string) {
+	d.link = link
+	if err := writeFileAtomic(d.file, []byte(link), 0600); err != nil {
+		log.Println("Delta:", err)
+	}
+}
+
+func (d *deltaPoller) Close() {
+	close(d.stop)
+	<-d.done
+}
+
+// invalidate drops the cached listings changed by v: the one of its parent, and if v is a folder
+// that has been moved, renamed or deleted, all listings below its old path
+func (o *oneManager) invalidate(v *driveItem) {
+	atomic.AddInt64(&o.searchGen, 1)
+
+	f := &o.folders
+	f.mu.Lock()
+	var drop []string
+	parent, ok := f.paths[v.ParentReference.ID]
+	if ok {
+		drop = append(drop, parent)
+	}
+	if old, known := f.paths[v.ID]; known && old != "/" {
+		// a folder whose parent was never listed can only be checked for a rename
+		moved := ok && parent+v.Name+"/" != old || !ok && !strings.HasSuffix(old, "/"+v.Name+"/")
+		if v.Deleted != nil || moved {
+			for id, p := range f.paths {
+				if strings.HasPrefix(p, old) {
+					drop = append(drop, p)
+					delete(f.paths, id)
+				}
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	for _, p := range drop {
+		o.cache.Remove(p)
+	}
+}
+
+// invalidateAll drops every cached listing
+func (o *oneManager) invalidateAll() {
+	atomic.AddInt64(&o.searchGen, 1)
+
+	f := &o.folders
+	f.mu.Lock()
+	for _, p := range f.paths {
+		o.cache.Remove(p)
+	}
+	f.paths = nil
+	f.mu.Unlock()
+	o.cache.Remove("/")
+}
+
+// startDelta polls the delta API if DeltaInterval is set, and subscribes to changes if NotifyURL is set
+func (o *oneManager) startDelta() {
+	switch {
+	case o.conf.DeltaInterval <= 0 && o.conf.NotifyURL == "":
+	case o.conf.SharedWithMe:
+		log.Println("Delta: not available for items shared with the account")
+	default:
+		o.delta = newDeltaPoller(o)
+		if o.conf.NotifyURL != "" {
+			o.notify = newSubscriber(o)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/coyove/common/lru"
+)
+
+// storedListing is a directory listing as written to CacheDir
+type storedListing struct {
+	Path   string       `json:"path"`
+	TS     int64        `json:"ts"`
+	Values []*driveItem `json:"value"`
+}
+
+// dirCache is the listing cache of a drive. With a directory set, listings are also written there
+// and read back at startup, keeping at most limit of them like the in-memory cache.
+type dirCache struct {
+	*lru.Cache
+	dir   string
+	limit int
+
+	mu     sync.Mutex
+	stored map[string]int64
+}
+
+func newDirCache(limit int, dir string) *dirCache {
+	return &dirCache{Cache: lru.NewCache(int64(limit)), dir: dir, limit: limit, stored: map[string]int64{}}
+}
+
+func (c *dirCache) file(path string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%x.json", sha1.Sum([]byte(path))))
+}
+
+// load fills the cache with the newest stored listings and removes the others
+func (c *dirCache) load() []*storedListing {
+	if c.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		log.Println("Cache dir:", err)
+		return nil
+	}
+
+	// files of writes cut short by a crash
+	tmp, _ := filepath.Glob(filepath.Join(c.dir, "*.json.tmp-*"))
+	for _, fn := range tmp {
+		os.Remove(fn)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	var res []*storedListing
+	for _, fn := range files {
+		buf, err := ioutil.ReadFile(fn)
+		v := &storedListing{}
+		if err == nil {
+			err = json.Unmarshal(buf, v)
+		}
+		if err != nil || c.file(v.Path) != fn {
+			os.Remove(fn)
+			continue
+		}
+		res = append(res, v)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].TS > res[j].TS })
+	if len(res) > c.limit {
+		for _, v := range res[c.limit:] {
+			os.Remove(c.file(v.Path))
+		}
+		res = res[:c.limit]
+	}
+
+	// the oldest go in first, so they are also the first to be evicted
+	for i := len(res) - 1; i >= 0; i-- {
+		v := res[i]
+		c.Cache.Add(v.Path, &driveItems{ts: v.TS, Values: v.Values})
+		c.stored[v.Path] = v.TS
+	}
+	log.Println("Cache dir:", c.dir, len(res), "listings loaded")
+	return res
+}
+
+// Add caches value under key, listings are written through to the cache dir
+func (c *dirCache) Add(key lru.Key, value interface{}) {
+	c.Cache.Add(key, value)
+
+	path, ok := key.(string)
+	x, ok2 := value.(*driveItems)
+	if c.dir == "" || !ok || !ok2 {
+		return
+	}
+
+	buf, _ := json.Marshal(&storedListing{Path: path, TS: x.ts, Values: x.Values})
+
+	// writers of the same path must not rename over each other, or the bookkeeping may
+	// miss a file that is on disk
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := writeFileAtomic(c.file(path), buf, 0600); err != nil {
+		log.Println("Cache dir:", err)
+		return
+	}
+
+	c.stored[path] = x.ts
+	for len(c.stored) > c.limit {
+		oldest := ""
+		for p, ts := range c.stored {
+			if oldest == "" || ts < c.stored[oldest] || ts == c.stored[oldest] && p < oldest {
+				oldest = p
+			}
+		}
+		delete(c.stored, oldest)
+		os.Remove(c.file(oldest))
+	}
+}
+
+// Remove drops key from the cache and the cache dir
+func (c *dirCache) Remove(key lru.Key) {
+	c.Cache.Remove(key)
+
+	path, ok := key.(string)
+	if c.dir == "" || !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, stored := c.stored[path]; stored {
+		delete(c.stored, path)
+		os.Remove(c.file(path))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gone-dircache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stored := func() int {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		return len(files)
+	}
+
+	c := newDirCache(3, dir)
+	c.load()
+	for i := 1; i <= 5; i++ {
+		c.Add(fmt.Sprintf("/a%d/", i), &driveItems{ts: int64(i), Values: []*driveItem{{Name: fmt.Sprint("file", i)}}})
+	}
+	if n := stored(); n != 3 {
+		t.Fatalf("%d listings on disk, want 3", n)
+	}
+	c.Remove("/a5/")
+	if _, err := os.Stat(c.file("/a5/")); !os.IsNotExist(err) {
+		t.Fatalf("the file of a removed listing is still there: %v", err)
+	}
+
+	// a restart loads what is left, leftovers of a crash and files of another path are dropped
+	ioutil.WriteFile(filepath.Join(dir, "x.json.tmp-1"), []byte("{"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "x.json"), []byte(`{"path":"/a1/","ts":1}`), 0600)
+	c = newDirCache(3, dir)
+	var loaded []string
+	for _, v := range c.load() {
+		loaded = append(loaded, v.Path)
+	}
+	if fmt.Sprint(loaded) != "[/a4/ /a3/]" {
+		t.Fatalf("loaded %v", loaded)
+	}
+	v, ok := c.Get("/a4/")
+	if x, _ := v.(*driveItems); !ok || x.ts != 4 || len(x.Values) != 1 || x.Values[0].Name != "file4" {
+		t.Fatalf("got %v for a loaded listing", v)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 2 {
+		t.Fatalf("%v left in the cache dir", files)
+	}
+
+	// a smaller CacheSize trims the dir at startup, keeping the newest
+	c = newDirCache(1, dir)
+	if res := c.load(); len(res) != 1 || res[0].Path != "/a4/" || stored() != 1 {
+		t.Fatalf("%d listings loaded and %d on disk with a CacheSize of 1", len(res), stored())
+	}
+}
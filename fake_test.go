@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeGraph is an in-memory Microsoft Graph and OAuth server, the tests run the whole stack against it
+type fakeGraph struct {
+	*httptest.Server
+	mu       sync.Mutex
+	files    map[string]string
+	changes  []fakeChange
+	subs     map[string]*subscription
+	errors   map[string]fakeFailure
+	code     string
+	pkce     string
+	scope    string
+	access   map[string]bool
+	refresh  map[string]bool
+	issued   int
+	polls    int
+	stall    time.Duration
+	PageSize int
+}
+
+func newFakeGraph() *fakeGraph {
+	f := &fakeGraph{
+		files:    map[string]string{},
+		errors:   map[string]fakeFailure{},
+		access:   map[string]bool{},
+		refresh:  map[string]bool{},
+		subs:     map[string]*subscription{},
+		code:     "fake-code",
+		PageSize: 200,
+	}
+	f.AddFile("/readme.md", "# Gone\n\nServed by the fake Microsoft Graph.\n")
+	f.AddFile("/docs/hello.txt", "hello world\n")
+	for i := 0; i < 250; i++ {
+		f.AddFile(fmt.Sprintf("/builds/build-%03d.zip", i), strings.Repeat("x", i))
+	}
+	// the seeded files date from long ago, later changes are stamped with the time they are made
+	for i := range f.changes {
+		f.changes[i].at = time.Time{}
+	}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+// fakeChange is an entry of the change log that the delta API reads
+type fakeChange struct {
+	path    string
+	deleted bool
+	at      time.Time
+}
+
+// AddFile creates a file at path, parent folders are implied
+func (f *fakeGraph) AddFile(path, content string) {
+	f.mu.Lock()
+	f.addFile(path, content)
+	f.mu.Unlock()
+}
+
+func (f *fakeGraph) addFile(path, content string) {
+	f.files[path] = content
+	f.changes = append(f.changes, fakeChange{path: path, at: time.Now()})
+	f.notify()
+}
+
+// Remove deletes the file or folder at path
+func (f *fakeGraph) Remove(path string) {
+	f.mu.Lock()
+	f.remove(path)
+	f.mu.Unlock()
+}
+
+func (f *fakeGraph) remove(path string) {
+	for fn := range f.files {
+		if fn == path || strings.HasPrefix(fn, path+"/") {
+			delete(f.files, fn)
+		}
+	}
+	f.changes = append(f.changes, fakeChange{path: path, deleted: true, at: time.Now()})
+	f.notify()
+}
+
+// notify sends a change notification to every subscription, like Graph it doesn't say what has changed
+func (f *fakeGraph) notify() {
+	for _, sub := range f.subs {
+		buf, _ := json.Marshal(map[string]interface{}{"value": []map[string]string{{
+			"subscriptionId": sub.ID,
+			"clientState":    sub.ClientState,
+			"resource":       sub.Resource,
+			"changeType":     "updated",
+		}}})
+		go http.Post(sub.NotificationURL, "application/json", bytes.NewReader(buf))
+	}
+}
+
+// serveSubscriptions creates, renews and deletes subscriptions, a new one is validated like Graph does
+func (f *fakeGraph) serveSubscriptions(w http.ResponseWriter, r *http.Request, p string) {
+	id := strings.TrimPrefix(strings.TrimPrefix(p, "/subscriptions"), "/")
+	sub := f.subs[id]
+	if id != "" && sub == nil {
+		f.writeError(w, http.StatusNotFound, "ResourceNotFound", "The object was not found.")
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && id == "":
+		sub = &subscription{}
+		if err := json.NewDecoder(r.Body).Decode(sub); err != nil || sub.NotificationURL == "" {
+			f.writeError(w, http.StatusBadRequest, "InvalidRequest", "Bad subscription")
+			return
+		}
+		token := fakeID(sub.NotificationURL + strconv.Itoa(len(f.subs)))
+		resp, err := http.Post(sub.NotificationURL+"?validationToken="+url.QueryEscape(token), "text/plain", nil)
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "InvalidRequest", "Subscription validation request failed: "+err.Error())
+			return
+		}
+		buf, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(buf) != token {
+			f.writeError(w, http.StatusBadRequest, "InvalidRequest", "Subscription validation request failed, the response doesn't match the token")
+			return
+		}
+		sub.ID = fmt.Sprintf("sub-%d", len(f.subs)+1)
+		f.subs[sub.ID] = sub
+		f.writeJSON(w, http.StatusCreated, sub)
+	case r.Method == "PATCH" && sub != nil:
+		v := &subscription{}
+		json.NewDecoder(r.Body).Decode(v)
+		sub.ExpirationDateTime = v.ExpirationDateTime
+		f.writeJSON(w, http.StatusOK, sub)
+	case r.Method == "DELETE" && sub != nil:
+		delete(f.subs, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.writeError(w, http.StatusMethodNotAllowed, "InvalidRequest", "Unsupported request")
+	}
+}
+
+// fakeFailure is an error injected by Fail, listings fail from the item at offset from on
+type fakeFailure struct {
+	status int
+	from   int
+}
+
+// Fail makes every Graph request on path answer with status and an error payload, 0 clears it
+func (f *fakeGraph) Fail(path string, status int) {
+	f.FailFrom(path, 0, status)
+}
+
+// FailFrom is Fail for the pages of a listing after the first from items, the earlier pages are still served
+func (f *fakeGraph) FailFrom(path string, from, status int) {
+	f.mu.Lock()
+	if status == 0 {
+		delete(f.errors, path)
+	} else {
+		f.errors[path] = fakeFailure{status: status, from: from}
+	}
+	f.mu.Unlock()
+}
+
+// Expire invalidates all access tokens, as if they have timed out
+func (f *fakeGraph) Expire() {
+	f.mu.Lock()
+	f.access = map[string]bool{}
+	f.mu.Unlock()
+}
+
+// SlowDownloads makes downloads pause for d halfway through the content
+func (f *fakeGraph) SlowDownloads(d time.Duration) {
+	f.mu.Lock()
+	f.stall = d
+	f.mu.Unlock()
+}
+
+// stallReader sleeps for stall once the first half of the content has been read
+type stallReader struct {
+	*strings.Reader
+	stall time.Duration
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	half := s.Size() / 2
+	pos := s.Size() - int64(s.Len())
+	if s.stall > 0 && pos >= half {
+		time.Sleep(s.stall)
+		s.stall = 0
+	}
+	if s.stall > 0 && int64(len(p)) > half-pos {
+		p = p[:half-pos]
+	}
+	return s.Reader.Read(p)
+}
+
+func fakeID(path string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(path)))[:16]
+}
+
+func (f *fakeGraph) item(path string) *driveItem {
+	dir, name := "", "root"
+	if path != "" {
+		dir, name = path[:strings.LastIndex(path, "/")], path[strings.LastIndex(path, "/")+1:]
+	}
+	version, modified := f.version(path)
+	item := &driveItem{
+		ID:                   fakeID(path),
+		ETag:                 `"{` + fakeID(path) + `},` + strconv.Itoa(version) + `"`,
+		Name:                 name,
+		CreatedDateTime:      "2018-01-01T00:00:00Z",
+		LastModifiedDateTime: modified,
+	}
+	item.ParentReference.DriveID, item.ParentReference.DriveType = "fake", "personal"
+	item.ParentReference.Path = "/drive/root:" + dir
+	if path != "" {
+		item.ParentReference.ID = fakeID(dir)
+	}
+
+	if content, ok := f.files[path]; ok {
+		item.Size = len(content)
+		item.DownloadURL = f.URL + "/download/" + item.ID
+		return item
+	}
+	if path == "" || len(f.children(path)) > 0 {
+		item.Folder = &_folder{ChildCount: len(f.children(path))}
+		return item
+	}
+	return nil
+}
+
+// version counts the changes at or below path and dates the latest of them, like personal OneDrive
+// the eTag of a folder changes whenever anything inside it does
+func (f *fakeGraph) version(path string) (int, string) {
+	n, at := 0, time.Time{}
+	for _, c := range f.changes {
+		if c.path == path || strings.HasPrefix(c.path, path+"/") {
+			n++
+			if c.at.After(at) {
+				at = c.at
+			}
+		}
+	}
+	if at.IsZero() {
+		return n, "2018-01-01T00:00:00Z"
+	}
+	return n, at.UTC().Format(time.RFC3339)
+}
+
+func (f *fakeGraph) children(path string) []string {
+	names := map[string]bool{}
+	for fn := range f.files {
+		if strings.HasPrefix(fn, path+"/") {
+			names[path+"/"+strings.SplitN(fn[len(path)+1:], "/", 2)[0]] = true
+		}
+	}
+
+	res := make([]string, 0, len(names))
+	for n := range names {
+		res = append(res, n)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (f *fakeGraph) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeGraph) writeError(w http.ResponseWriter, status int, code, msg string) {
+	f.writeJSON(w, status, map[string]interface{}{
+		"error": graphError{Code: code, Message: msg},
+	})
+}
+
+func (f *fakeGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch p := r.URL.Path; {
+	case strings.HasSuffix(p, "/oauth2/v2.0/authorize"):
+		u, err := url.Parse(r.FormValue("redirect_uri"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q := u.Query()
+		q.Set("code", f.code)
+		f.pkce = r.FormValue("code_challenge")
+		f.scope = r.FormValue("scope")
+		if state := r.FormValue("state"); state != "" {
+			q.Set("state", state)
+		}
+		u.RawQuery = q.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	case strings.HasSuffix(p, "/oauth2/v2.0/devicecode"):
+		f.polls = 0
+		f.scope = r.FormValue("scope")
+		f.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"device_code":      f.code,
+			"user_code":        "FAKE-CODE",
+			"verification_uri": f.URL + "/devicelogin",
+			"expires_in":       900,
+			"interval":         1,
+			"message":          "To sign in, open " + f.URL + "/devicelogin and enter the code FAKE-CODE, the fake approves it on the second poll.",
+		})
+	case strings.HasSuffix(p, "/oauth2/v2.0/token"):
+		f.serveToken(w, r)
+	case strings.HasPrefix(p, "/download/"):
+		// gone may append "/<name>" to the download URL
+		id := strings.SplitN(p[len("/download/"):], "/", 2)[0]
+		for fn, content := range f.files {
+			if fakeID(fn) == id {
+				stall := f.stall
+				f.mu.Unlock()
+				w.Header().Set("Content-Type", "application/octet-stream")
+				http.ServeContent(w, r, "", time.Time{}, &stallReader{strings.NewReader(content), stall})
+				f.mu.Lock()
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case strings.HasPrefix(p, "/v1.0/"):
+		if !f.access[strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")] {
+			f.writeError(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "Access token has expired or is not yet valid.")
+			return
+		}
+		f.serveGraph(w, r, p[len("/v1.0"):])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeGraph) serveToken(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		if r.FormValue("code") != f.code {
+			f.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "bad code"})
+			return
+		}
+		if sum := sha256.Sum256([]byte(r.FormValue("code_verifier"))); f.pkce != "" && base64.RawURLEncoding.EncodeToString(sum[:]) != f.pkce {
+			f.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "bad code verifier"})
+			return
+		}
+	case "urn:ietf:params:oauth:grant-type:device_code":
+		if r.FormValue("device_code") != f.code {
+			f.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_verification_code"})
+			return
+		}
+		if f.polls++; f.polls < 2 {
+			f.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "authorization_pending"})
+			return
+		}
+	case "refresh_token":
+		if !f.refresh[r.FormValue("refresh_token")] {
+			f.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "bad refresh token"})
+			return
+		}
+	case "client_credentials":
+		if r.FormValue("client_secret") == "" && r.FormValue("client_assertion") == "" {
+			f.writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client", "error_description": "no credentials"})
+			return
+		}
+		f.issued++
+		access := "app-" + strconv.Itoa(f.issued)
+		f.access[access] = true
+		f.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"access_token": access,
+		})
+		return
+	default:
+		f.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	// every sign-in gets its own tokens, so several drives can share the fake
+	delete(f.refresh, r.FormValue("refresh_token"))
+	f.issued++
+	access, refresh := "access-"+strconv.Itoa(f.issued), "refresh-"+strconv.Itoa(f.issued)
+	f.access[access], f.refresh[refresh] = true, true
+	scope := "Files.Read.All"
+	if strings.Contains(f.scope, "Files.ReadWrite.All") {
+		scope = "Files.ReadWrite.All"
+	}
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token_type":    "Bearer",
+		"scope":         scope,
+		"expires_in":    3600,
+		"access_token":  access,
+		"refresh_token": refresh,
+	})
+}
+
+// pathOf finds the file or folder whose fake ID is id
+func (f *fakeGraph) pathOf(id string) (string, bool) {
+	for fn := range f.files {
+		for p := fn; ; p = p[:strings.LastIndex(p, "/")] {
+			if fakeID(p) == id {
+				return p, true
+			}
+			if p == "" {
+				break
+			}
+		}
+	}
+	return "", false
+}
+
+func (f *fakeGraph) serveGraph(w http.ResponseWriter, r *http.Request, p string) {
+	// all drives, sites and users share the same files, /docs and /readme.md are also shared with the account
+	switch {
+	case p == "/subscriptions" || strings.HasPrefix(p, "/subscriptions/"):
+		f.serveSubscriptions(w, r, p)
+		return
+	case p == "/me/drive/sharedWithMe":
+		var values []map[string]interface{}
+		for _, fn := range []string{"/docs", "/readme.md"} {
+			values = append(values, map[string]interface{}{"name": fn[1:], "remoteItem": f.item(fn)})
+		}
+		f.writeJSON(w, http.StatusOK, map[string]interface{}{"value": values})
+		return
+	case strings.HasPrefix(p, "/me/drive/"):
+		p = p[len("/me/drive"):]
+	case strings.HasPrefix(p, "/drives/"):
+		p = p[len("/drives/"):]
+		p = p[strings.Index(p+"/", "/"):]
+	case (strings.HasPrefix(p, "/sites/") || strings.HasPrefix(p, "/users/")) && strings.Contains(p, "/drive/"):
+		p = p[strings.Index(p, "/drive/")+len("/drive"):]
+	}
+
+	// {/root,/items/{id}}[:/path[:]][/action]
+	base := ""
+	switch {
+	case strings.HasPrefix(p, "/root"):
+		p = p[len("/root"):]
+	case strings.HasPrefix(p, "/items/"):
+		id := strings.FieldsFunc(p[len("/items/"):], func(r rune) bool { return r == '/' || r == ':' })[0]
+		var ok bool
+		if base, ok = f.pathOf(id); !ok {
+			f.writeError(w, http.StatusNotFound, "itemNotFound", "The resource could not be found.")
+			return
+		}
+		p = p[len("/items/")+len(id):]
+	default:
+		f.writeError(w, http.StatusBadRequest, "invalidRequest", "Invalid request")
+		return
+	}
+
+	path, action := p, ""
+	if strings.HasPrefix(path, ":") {
+		path = path[1:]
+		if idx := strings.LastIndex(path, ":/"); idx > -1 {
+			path, action = path[:idx], path[idx+2:]
+		}
+	} else {
+		action = strings.TrimPrefix(path, "/")
+		path = ""
+	}
+	path = base + strings.TrimSuffix(path, "/")
+
+	skip, _ := strconv.Atoi(r.FormValue("$skiptoken"))
+	if e := f.errors[path]; e.status != 0 && skip >= e.from {
+		if e.status == http.StatusTooManyRequests || e.status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+		}
+		f.writeError(w, e.status, "serviceNotAvailable", "Injected error")
+		return
+	}
+
+	switch {
+	case r.Method == "PUT" && action == "content":
+		buf, _ := ioutil.ReadAll(r.Body)
+		f.addFile(path, string(buf))
+		f.writeJSON(w, http.StatusCreated, f.item(path))
+		return
+	case r.Method == "DELETE" && action == "" && path != "" && f.item(path) != nil:
+		f.remove(path)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case action == "delta" && path == "":
+		f.serveDelta(w, r)
+		return
+	}
+
+	item := f.item(path)
+	if item == nil {
+		f.writeError(w, http.StatusNotFound, "itemNotFound", "The resource could not be found.")
+		return
+	}
+
+	var values []*driveItem
+	switch {
+	case action == "":
+		f.writeJSON(w, http.StatusOK, item)
+		return
+	case action == "children":
+		for _, c := range f.children(path) {
+			values = append(values, f.item(c))
+		}
+	case strings.HasPrefix(action, "search(q='") && strings.HasSuffix(action, "')"):
+		q := strings.ToLower(strings.Replace(action[10:len(action)-2], "''", "'", -1))
+		for fn := range f.files {
+			if strings.HasPrefix(fn, path+"/") && strings.Contains(strings.ToLower(fn[strings.LastIndex(fn, "/")+1:]), q) {
+				values = append(values, f.item(fn))
+			}
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	default:
+		f.writeError(w, http.StatusBadRequest, "invalidRequest", "Unknown action: "+action)
+		return
+	}
+
+	top, _ := strconv.Atoi(r.FormValue("$top"))
+	if top <= 0 || top > f.PageSize {
+		top = f.PageSize
+	}
+	if skip > len(values) {
+		skip = len(values)
+	}
+
+	resp := map[string]interface{}{}
+	if end := skip + top; end < len(values) {
+		next := &url.URL{Path: r.URL.Path, RawQuery: url.Values{
+			"$top":       []string{strconv.Itoa(top)},
+			"$skiptoken": []string{strconv.Itoa(end)},
+		}.Encode()}
+		resp["@odata.nextLink"] = f.URL + next.String()
+		values = values[skip:end]
+	} else {
+		values = values[skip:]
+	}
+	resp["value"] = values
+	f.writeJSON(w, http.StatusOK, resp)
+}
+
+// serveDelta answers the changes since the token, which is a position in the change log.
+// Like Graph, items come with their ancestors and without a path.
+func (f *fakeGraph) serveDelta(w http.ResponseWriter, r *http.Request) {
+	pos, err := strconv.Atoi(r.FormValue("token"))
+	switch {
+	case r.FormValue("token") == "latest":
+		pos = len(f.changes)
+	case r.FormValue("token") == "":
+		pos = 0
+	case err != nil || pos < 0 || pos > len(f.changes):
+		f.writeError(w, http.StatusGone, "resyncRequired", "The delta token is no longer valid.")
+		return
+	}
+
+	seen := map[string]bool{}
+	values := []*driveItem{}
+	for _, c := range f.changes[pos:] {
+		for p := c.path; !seen[p]; p = p[:strings.LastIndex(p, "/")] {
+			seen[p] = true
+			item := f.item(p)
+			if item == nil {
+				item = &driveItem{ID: fakeID(p), Name: p[strings.LastIndex(p, "/")+1:], Deleted: &struct{}{}}
+				item.ParentReference.ID = fakeID(p[:strings.LastIndex(p, "/")])
+			}
+			item.ParentReference.Path = ""
+			values = append(values, item)
+			if p == "" {
+				break
+			}
+		}
+	}
+
+	link := &url.URL{Path: r.URL.Path, RawQuery: url.Values{"token": []string{strconv.Itoa(len(f.changes))}}.Encode()}
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"value":            values,
+		"@odata.deltaLink": f.URL + link.String(),
+	})
+}
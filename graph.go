@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	graphRetries    = 3
+	graphBackoff    = 500 * time.Millisecond
+	graphMaxBackoff = 4 * time.Second
+	// a longer Retry-After is not waited for, the breaker opens and the caller falls back instead
+	graphMaxWait     = 30 * time.Second
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+var errGraphUnavailable = errors.New("OneDrive is not available at the moment, please try again later")
+
+// breaker stops calling Graph for a while after too many consecutive failures
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.openUntil) {
+		return errGraphUnavailable
+	}
+	return nil
+}
+
+// record counts a failure or resets the count on success, wait is how long Graph asked us to stay away
+func (b *breaker) record(ok bool, wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if wait < breakerCooldown {
+		wait = breakerCooldown
+	}
+	if b.failures >= breakerThreshold || wait > graphMaxWait {
+		if until := time.Now().Add(wait); until.After(b.openUntil) {
+			b.openUntil = until
+			log.Println("Graph is unhealthy, pausing requests until", until.Format(time.RFC3339))
+		}
+	}
+}
+
+// State describes the breaker for the info page
+func (b *breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.openUntil) {
+		return "open until " + b.openUntil.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("closed, %d recent failures", b.failures)
+}
+
+// retryAfter parses the Retry-After header, which holds either seconds or an HTTP date
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// get sends a GET to Graph, throttled and failed attempts are retried with backoff
+// as long as Graph doesn't ask for a longer pause than graphMaxWait.
+// A call that ends with an error or a 5xx is one failure for the breaker.
+func (o *oneManager) get(ctx context.Context, endpoint, access string) (*http.Response, error) {
+	backoff := graphBackoff
+	for attempt := 0; ; attempt++ {
+		if err := o.breaker.allow(); err != nil {
+			return nil, err
+		}
+
+		resp, err := o.httpClient.Do(o.MakeRequest(ctx, endpoint, access))
+		if ctx.Err() != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+
+		var wait time.Duration
+		switch {
+		case err != nil:
+		case retryable(resp.StatusCode):
+			wait = retryAfter(resp.Header)
+		default:
+			// any other 5xx is not worth a retry, but it is a failure of Graph all the same
+			o.breaker.record(resp.StatusCode < 500, 0)
+			return resp, nil
+		}
+
+		// the breaker counts calls, the attempts of one call are a single failure
+		if attempt == graphRetries || wait > graphMaxWait {
+			o.breaker.record(false, wait)
+			if err != nil {
+				return nil, err
+			}
+			return resp, nil
+		}
+
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			log.Println("Graph answered", resp.Status, "for", endpoint, "retry", attempt+1)
+		} else {
+			log.Println("Graph:", err, "retry", attempt+1)
+		}
+
+		if wait == 0 {
+			wait = backoff + time.Duration(rand.Int63n(int64(backoff)))
+			if backoff *= 2; backoff > graphMaxBackoff {
+				backoff = graphMaxBackoff
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
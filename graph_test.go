@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestBreakerCountsCalls(t *testing.T) {
+	e := newTestEnv(t, nil)
+	defer e.Close()
+	e.signIn(t)
+	o := e.m.one
+	failures := func() int {
+		o.breaker.mu.Lock()
+		defer o.breaker.mu.Unlock()
+		return o.breaker.failures
+	}
+
+	// the retries of a throttled call are one failure
+	e.f.Fail("/docs", http.StatusServiceUnavailable)
+	if x := o.List(context.Background(), "/docs/"); x.Error.Message == "" {
+		t.Fatal("a throttled listing has succeeded")
+	}
+	if n := failures(); n != 1 {
+		t.Fatalf("%d failures after one throttled call, want 1", n)
+	}
+
+	// a 500 is not retried, but it counts as a failure, not as a success
+	e.f.Fail("/docs", http.StatusInternalServerError)
+	for i := 2; i < breakerThreshold; i++ {
+		o.List(context.Background(), "/docs/")
+		if n := failures(); n != i {
+			t.Fatalf("%d failures after %d failed calls", n, i)
+		}
+	}
+	if err := o.breaker.allow(); err != nil {
+		t.Fatal("the breaker has opened before the threshold")
+	}
+	o.List(context.Background(), "/docs/")
+	if err := o.breaker.allow(); err != errGraphUnavailable {
+		t.Fatalf("the breaker is still closed after %d failures", failures())
+	}
+}
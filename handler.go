@@ -2,7 +2,7 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -11,8 +11,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
 	"time"
 
@@ -31,56 +31,188 @@ func writeError(w http.ResponseWriter, msg string) {
 		`, msg)))
 }
 
-func writeInfo(w http.ResponseWriter) {
-	http.SetCookie(w, &http.Cookie{
-		Name:    "admin",
-		Value:   o.conf.Password,
-		Expires: time.Now().AddDate(1, 0, 0),
-	})
+// masked copies c with its secrets, and those of its drives, replaced
+func (c *config) masked() *config {
+	x := *c
+	x.Password, x.SessionSecret, x.TokenKey, x.ClientSecret = "******", "******", "******", "******"
+	x.Drives = nil
+	for _, d := range c.Drives {
+		x.Drives = append(x.Drives, d.masked())
+	}
+	return &x
+}
 
+// maskToken shows just enough of a token to tell it apart from another one
+func maskToken(t string) string {
+	if t == "" {
+		return "none"
+	}
+	if len(t) <= 16 {
+		return "******"
+	}
+	return template.HTMLEscapeString(t[:8]) + "******"
+}
+
+func writeInfo(w http.ResponseWriter) {
 	w.Write([]byte(`<html>
 		<head><meta charset="UTF-8"><title>Info</title></head>
 		<body bgcolor="white">
 		<pre>`))
 
-	buf, _ := json.MarshalIndent(o.conf, "", "  ")
+	buf, _ := json.MarshalIndent(conf.masked(), "", "  ")
 	w.Write(buf)
 
 	w.Write([]byte("<hr>"))
 
-	w.Write([]byte("Access:\n" + o.access + "<hr>Refresh:\n" + o.refresh + "<hr>"))
+	for _, m := range mounts {
+		if m.one == nil {
+			continue
+		}
+		if m.Prefix != "" {
+			w.Write([]byte("Drive: " + m.Prefix + "\n"))
+		}
 
-	o.cache.Info(func(k lru.Key, v interface{}, hits, weight int64) {
-		w.Write([]byte(fmt.Sprintf("%6d %s\n", hits, k)))
-	})
+		t := m.one.tokens.Tokens()
+		w.Write([]byte("Access: " + maskToken(t.Access) + ", expires " + time.Unix(t.expiry(false), 0).Format(time.RFC3339) +
+			"\nRefresh: " + maskToken(t.Refresh) + "<hr>"))
+		w.Write([]byte("Graph: " + m.one.breaker.State() + "<hr>"))
 
-	w.Write([]byte("<hr>"))
+		m.one.cache.Info(func(k lru.Key, v interface{}, hits, weight int64) {
+			w.Write([]byte(fmt.Sprintf("%6d %s\n", hits, k)))
+		})
 
-	o.prefetch.Info(func(k lru.Key, v interface{}, hits, weight int64) {
+		w.Write([]byte("<hr>"))
+	}
+
+	prefetch.Info(func(k lru.Key, v interface{}, hits, weight int64) {
 		w.Write([]byte(fmt.Sprintf("p %6d %s\n", hits, k)))
 	})
 	w.Write([]byte("</pre></body></html>"))
 }
 
-func serveFile(w http.ResponseWriter, r *http.Request, fn string, values []*driveItem) bool {
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONList writes the already sorted values, hidden items are only listed to admins
+func writeJSONList(w http.ResponseWriter, m *mount, path, query string, x *driveItems, isAdmin bool) {
+	list := listing{Path: path, Query: query, Warning: x.warning, Items: []listItem{}}
+	for _, item := range x.Values {
+		if item.isHidden && !isAdmin {
+			continue
+		}
+
+		li := listItem{
+			Name:                 item.Name,
+			Size:                 item.Size,
+			CreatedDateTime:      item.CreatedDateTime,
+			LastModifiedDateTime: item.LastModifiedDateTime,
+			Href:                 itemHref(m, path, item),
+			Hidden:               item.isHidden,
+		}
+		if item.Folder != nil {
+			li.Folder = true
+			li.ChildCount = item.Folder.ChildCount
+		}
+		list.Items = append(list.Items, li)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func itemHref(m *mount, path string, item *driveItem) string {
+	if item.href != "" {
+		return item.href
+	}
+	if item.Folder != nil {
+		return path + item.Name
+	}
+	if m.conf.prefetchRegex != nil && m.conf.prefetchRegex.MatchString(item.Name) {
+		return "?file=" + url.QueryEscape(item.Name)
+	}
+	return m.backend.DownloadURL(item)
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, m *mount, fn string, values []*driveItem) bool {
 	for _, item := range values {
 		if item.Name == fn {
-			hash := fmt.Sprintf("%x", sha1.Sum([]byte(fn)))
-			cachepath := "cache/" + hash[:2] + "/" + hash[2:4]
-			os.MkdirAll(cachepath, 0755)
-			cachepath += "/" + hash[4:] + "-" + fn
-			o.prefetch.Get(cachepath)
-
-			if _, err := os.Stat(cachepath); err == nil {
-				http.ServeFile(w, r, cachepath)
+			etag, modtime := itemETag(item), itemModTime(item)
+			if etag != "" {
+				w.Header().Set("ETag", etag)
+			}
+
+			if l, ok := m.backend.(localFiler); ok {
+				http.ServeFile(w, r, l.LocalPath(item))
+				return true
+			}
+
+			cachepath := cachePath(item)
+			os.MkdirAll(filepath.Dir(cachepath), 0755)
+			prefetch.Get(cachepath)
+
+			if f, err := os.Open(cachepath); err == nil {
+				defer f.Close()
+				http.ServeContent(w, r, fn, modtime, f)
+				return true
+			}
+
+			// a miss may also mean the item has changed upstream, drop its older versions
+			dir, name := filepath.Split(cachepath)
+			stale, _ := filepath.Glob(dir + name[:strings.Index(name, ".")] + ".*")
+			for _, path := range stale {
+				if path != cachepath {
+					prefetch.Remove(path)
+					os.Remove(path)
+				}
+			}
+
+			if notModified(r, etag, modtime) {
+				w.WriteHeader(http.StatusNotModified)
 				return true
 			}
 
-			resp, err := o.httpClient.Get(item.DownloadURL)
+			// a range request is forwarded upstream and the partial body is not cached,
+			// unless If-Range says the client's copy is stale and the whole file is wanted.
+			// Players often ask for bytes=0-, which is the whole file and fills the cache.
+			var h http.Header
+			if rg := r.Header.Get("Range"); rg != "" && rg != "bytes=0-" && ifRange(r, etag, modtime) {
+				h = http.Header{"Range": []string{rg}}
+			}
+
+			var d *download
+			if h == nil {
+				var leader bool
+				if d, leader = startDownload(cachepath); !leader {
+					select {
+					case <-d.done:
+					case <-r.Context().Done():
+						return true
+					}
+					if f, err := os.Open(cachepath); d.ok && err == nil {
+						defer f.Close()
+						http.ServeContent(w, r, fn, modtime, f)
+					} else {
+						writeError(w, "Failed to fetch "+template.HTMLEscapeString(fn))
+					}
+					return true
+				}
+				defer d.finish(cachepath)
+			}
+
+			// the cache is filled even if the client that started the download goes away
+			ctx := r.Context()
+			if d != nil {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(context.Background(), prefetchTimeout)
+				defer cancel()
+			}
+			resp, err := m.backend.Open(ctx, item, h)
 			if err != nil {
-				writeError(w, err.Error())
+				writeError(w, template.HTMLEscapeString(err.Error()))
 				return true
 			}
+			defer resp.Body.Close()
 
 			for k, vs := range resp.Header {
 				if k == "Content-Disposition" {
@@ -93,23 +225,23 @@ func serveFile(w http.ResponseWriter, r *http.Request, fn string, values []*driv
 					}
 				}
 			}
+			if etag != "" {
+				w.Header().Set("ETag", etag)
+			}
+			if !modtime.IsZero() {
+				w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+			}
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.WriteHeader(resp.StatusCode)
 
-			cachefile, err := os.OpenFile(cachepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
-			var writer io.Writer
-			if err == nil {
-				writer = io.MultiWriter(w, cachefile)
-				defer cachefile.Close()
-			} else {
-				writer = w
+			if d == nil || resp.StatusCode != http.StatusOK {
+				io.Copy(w, resp.Body)
+				return true
 			}
 
-			n, err := io.Copy(writer, resp.Body)
-			if err == nil {
-				o.prefetch.AddWeight(cachepath, true, n)
-			} else {
-				log.Println(err)
+			if err := d.fill(w, resp.Body, cachepath, int64(item.Size)); err != nil {
+				log.Println("Prefetch", cachepath, err)
 			}
-			resp.Body.Close()
 			return true
 		}
 	}
@@ -117,31 +249,45 @@ func serveFile(w http.ResponseWriter, r *http.Request, fn string, values []*driv
 }
 
 func Main(w http.ResponseWriter, r *http.Request) {
-	admincookie, _ := r.Cookie("admin")
-	isAdmin := admincookie != nil && admincookie.Value == o.conf.Password
+	admin := isAdmin(r)
 
 	if img := r.FormValue("image"); img != "" {
 		w.Header().Add("Content-Type", "image/png")
 		w.Header().Add("Cache-Control", "max-age=31536000")
-		w.Write(o.icons[img])
+		w.Write(DefaultIcons[img])
 		return
 	}
 
-	if r.FormValue("auth") == o.conf.Password {
-		url0 := "https://login.microsoftonline.com/common/oauth2/v2.0/authorize?client_id=%s&scope=files.readwrite.all+offline_access&response_type=code&redirect_uri=%s"
-		url0 = fmt.Sprintf(url0, o.conf.ClientID, o.conf.RedirURL)
-		http.Redirect(w, r, url0, http.StatusTemporaryRedirect)
+	q := r.URL.Query()
+	if _, ok := q["login"]; ok {
+		Login(w, r)
+		return
+	}
+	if _, ok := q["logout"]; ok {
+		Logout(w, r)
 		return
 	}
 
-	if r.FormValue("info") == o.conf.Password {
+	_, auth := q["auth"]
+	_, info := q["info"]
+	if (auth || info) && !admin {
+		http.Redirect(w, r, "/?login", http.StatusTemporaryRedirect)
+		return
+	}
+
+	if m, _ := mountOf(r.URL.Path); m != nil && m.one != nil && !m.conf.appOnly() && auth {
+		StartAuth(w, r, m)
+		return
+	}
+
+	if info {
 		writeInfo(w)
 		return
 	}
 
 	if strings.HasPrefix(r.RequestURI, "/favicon.ico") {
-		if o.conf.Favicon != "" {
-			http.ServeFile(w, r, o.conf.Favicon)
+		if conf.Favicon != "" {
+			http.ServeFile(w, r, conf.Favicon)
 		} else {
 			http.Redirect(w, r, "https://onedrive.live.com/favicon.ico", http.StatusTemporaryRedirect)
 		}
@@ -150,9 +296,8 @@ func Main(w http.ResponseWriter, r *http.Request) {
 
 	// format the path
 	path := r.URL.Path[1:]
-	order, revorder, orderfunc := r.FormValue("o"), "d", _orderAsc
-	if order == "d" {
-		revorder = "a"
+	orderfunc := _orderAsc
+	if r.FormValue("o") == "d" {
 		orderfunc = _orderDesc
 	}
 
@@ -164,37 +309,124 @@ func Main(w http.ResponseWriter, r *http.Request) {
 	}
 	if path[len(path)-1] != '/' {
 		path += "/"
+		if r.URL.RawQuery != "" {
+			path += "?" + r.URL.RawQuery
+		}
 		http.Redirect(w, r, path, http.StatusTemporaryRedirect)
 		return
 	}
 
 	// we will have a path that always start with / and end with /
 	start := time.Now()
-	x := o.List(path)
+	asJSON := r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+
+	if query := strings.TrimSpace(r.FormValue("q")); query != "" {
+		m, x := searchPath(r.Context(), path, query, admin)
+		elapsed := time.Now().Sub(start)
+		if x.Error.Message != "" {
+			if asJSON {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": x.Error.Message})
+			} else {
+				writeError(w, template.HTMLEscapeString(x.Error.Message))
+			}
+			return
+		}
+
+		// the whole drive is searched wherever the search box was used
+		root := "/"
+		if m != nil && m.Prefix != "" {
+			root += m.Prefix + "/"
+		}
+		if c := r.FormValue("c"); c != "" {
+			sortValues(c, x.Values, orderfunc)
+		} else if strings.HasPrefix(query, recentPrefix) {
+			sortValues("t", x.Values, _orderDesc)
+		}
+		if asJSON {
+			writeJSONList(w, m, root, query, x, admin)
+			return
+		}
+		writeIndex(w, r, m, root, query, x, admin, elapsed)
+		return
+	}
+
+	m, x := listPath(r.Context(), path)
 	elapsed := time.Now().Sub(start)
 
 	if x.Error.Message != "" {
-		writeError(w, x.Error.Message)
+		if asJSON {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": x.Error.Message})
+		} else {
+			writeError(w, template.HTMLEscapeString(x.Error.Message))
+		}
 		return
 	}
 
 	fn := r.FormValue("file")
-	if fn != "" && o.conf.prefetchRegex != nil && o.conf.prefetchRegex.MatchString(fn) {
-		if serveFile(w, r, fn, x.Values) {
-			return
+	if fn != "" && m != nil && (admin || !m.hidden(fn)) {
+		if m.served(fn) {
+			if serveFile(w, r, m, fn, x.Values) {
+				return
+			}
+		} else {
+			// search results from the index link here, as their download URLs would have expired
+			for _, item := range x.Values {
+				if item.Name == fn && item.Folder == nil {
+					http.Redirect(w, r, m.backend.DownloadURL(item), http.StatusFound)
+					return
+				}
+			}
 		}
 	}
 
+	// the listing is shared with the cache and other requests, mark and sort copies of its items
+	values := make([]*driveItem, len(x.Values))
+	for i, v := range x.Values {
+		item := *v
+		item.isHidden = m.hidden(item.Name)
+		values[i] = &item
+	}
+	sortValues(r.FormValue("c"), values, orderfunc)
+	c := *x
+	c.Values = values
+	x = &c
+
+	if asJSON {
+		writeJSONList(w, m, path, "", x, admin)
+		return
+	}
+	writeIndex(w, r, m, path, "", x, admin, elapsed)
+}
+
+// writeIndex renders the sorted values in columns, query is set when they are search results
+func writeIndex(w http.ResponseWriter, r *http.Request, m *mount, path, query string, x *driveItems, admin bool, elapsed time.Duration) {
+	revorder := "d"
+	if r.FormValue("o") == "d" {
+		revorder = "a"
+	}
+
 	upath, _ := url.PathUnescape(path)
+	title, sortq, up := "Index of "+upath, "?", "../"
+	if query != "" {
+		title = "Search results for \"" + template.HTMLEscapeString(query) + "\" in " + upath
+		sortq, up = "?q="+url.QueryEscape(query)+"&", "./"
+	} else if path == "/" && conf.TopBackRedir != "" {
+		up = conf.TopBackRedir
+	}
+
 	w.Write([]byte(fmt.Sprintf(`<html>
-<head><meta charset="UTF-8"><title>Index of %s</title></head>
+<head><meta charset="UTF-8"><title>%s</title></head>
 <body bgcolor="white">
-<h1 id=indexof>Index of %s</h1>%s<pre>`, upath, upath, o.conf.Header)))
+<h1 id=indexof>%s</h1>
+<form><input type="search" name="q" value="%s" placeholder="Search"></form>%s<pre>`,
+		title, title, template.HTMLEscapeString(query), conf.Header)))
+	if x.warning != "" {
+		w.Write([]byte("<b>" + template.HTMLEscapeString(x.warning) + "</b><hr>"))
+	}
 
 	maxNameLen, maxSizeLen := 6, 2
 	for i := len(x.Values) - 1; i >= 0; i-- {
 		item := x.Values[i]
-		item.isHidden = o.conf.ignoreRegex != nil && o.conf.ignoreRegex.MatchString(item.Name)
 
 		l := strlen(item.Name)
 		if item.Folder != nil {
@@ -207,49 +439,38 @@ func Main(w http.ResponseWriter, r *http.Request) {
 		if l > maxNameLen {
 			maxNameLen = l
 		}
-		if s := prettySize(item.Size); len(s) > maxSizeLen {
+		if s := displaySize(item); len(s) > maxSizeLen {
 			maxSizeLen = len(s)
 		}
 	}
 
-	// sort values based on user's choice
-	sortValues(r.FormValue("c"), x.Values, orderfunc)
-
 	w.Write([]byte(
-		`<img src="?image=empty.png"> <a href="?c=n&o=` + revorder + `">Name</a>` + spaces(maxNameLen+1-4) +
-			`<a href="?c=t&o=` + revorder + `">Last Modified</a>   ` +
-			spaces(maxSizeLen+2-4) + `<a href="?c=s&o=` + revorder + `">Size</a>`,
+		`<img src="?image=empty.png"> <a href="` + sortq + `c=n&o=` + revorder + `">Name</a>` + spaces(maxNameLen+1-4) +
+			`<a href="` + sortq + `c=t&o=` + revorder + `">Last Modified</a>   ` +
+			spaces(maxSizeLen+2-4) + `<a href="` + sortq + `c=s&o=` + revorder + `">Size</a>`,
 	))
 
-	up := "../"
-	if path == "/" && o.conf.TopBackRedir != "" {
-		up = o.conf.TopBackRedir
-	}
 	w.Write([]byte(fmt.Sprintf(`<hr><img src="?image=back.png"> <a href="%s">Parent Directory</a>%s-
 `, up, spaces(maxSizeLen+maxNameLen+16+3-16-1))))
 
 	var readme []byte
 	for _, item := range x.Values {
-		href := item.DownloadURL + "/" + item.Name
+		href := itemHref(m, path, item)
 		name := item.Name
-
 		if item.Folder != nil {
-			href = path + name
 			name += "/"
-		} else if o.conf.prefetchRegex != nil && o.conf.prefetchRegex.MatchString(name) {
-			href = "?file=" + name
 		}
 
 		if item.isHidden {
-			if isAdmin {
+			if admin {
 				name = "* " + name
 			} else {
 				continue
 			}
 		}
 
-		if !o.conf.DisableReadme {
-			readme = renderReadme(name, x.Values, r)
+		if !conf.DisableReadme && m != nil && query == "" {
+			readme = renderReadme(m, name, x.Values, r)
 		}
 
 		w.Write([]byte(fmt.Sprintf("<img src='?image=%s'> ", nameIcon(name, item.Folder != nil))))
@@ -257,10 +478,7 @@ func Main(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(spaces(maxNameLen + 1 - strlen(name))))
 		w.Write([]byte(item.LastModifiedDateTime[:10] + " " + item.LastModifiedDateTime[11:16]))
 
-		size := prettySize(item.Size)
-		if item.Folder != nil {
-			size = "(" + strconv.Itoa(item.Folder.ChildCount) + ")"
-		}
+		size := displaySize(item)
 
 		w.Write(bytes.Repeat([]byte(" "), maxSizeLen+2-len(size)))
 		w.Write([]byte(size))
@@ -269,13 +487,14 @@ func Main(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte(`</pre><hr>`))
 	w.Write(readme)
-	w.Write([]byte(o.conf.Footer))
+	w.Write([]byte(conf.Footer))
 	w.Write([]byte(fmt.Sprintf(`
-<address><a href="https://github.com/coyove/gone" target=_blank>Gone</a> (%s) Server in %.2fs,
-Last token lives %ds
-</address>`,
+<address><a href="https://github.com/coyove/gone" target=_blank>Gone</a> (%s) Server in %.2fs`,
 		runtime.GOOS,
-		elapsed.Seconds(),
-		time.Now().Unix()-o.lastRefreshed)))
+		elapsed.Seconds())))
+	if m != nil && m.one != nil {
+		w.Write([]byte(fmt.Sprintf(",\nLast token lives %ds\n", time.Now().Unix()-m.one.tokens.Tokens().Refreshed)))
+	}
+	w.Write([]byte("</address>"))
 	w.Write([]byte("</body></html>"))
 }
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMainListing(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.Ignore = `^build-00[0-9]\.zip$` })
+	defer e.Close()
+	e.signIn(t)
+
+	resp, body := e.get(t, e.client(false), "/builds/", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "build-249.zip") {
+		t.Fatalf("got %s without build-249.zip", resp.Status)
+	}
+	if strings.Contains(body, "build-001.zip") {
+		t.Fatal("an ignored file is listed")
+	}
+
+	resp, _ = e.get(t, e.client(false), "/builds", nil)
+	if resp.Request.URL.Path != "/builds/" {
+		t.Fatalf("/builds ended at %s, want /builds/", resp.Request.URL.Path)
+	}
+
+	e.f.Fail("/docs", http.StatusInternalServerError)
+	if _, body := e.get(t, e.client(false), "/docs/", nil); !strings.Contains(body, "Injected error") {
+		t.Fatal("the Graph error is not shown")
+	}
+}
+
+func TestJSONListing(t *testing.T) {
+	e := newTestEnv(t, func(c *config) {
+		c.Ignore = `^readme\.md$`
+		c.Prefetch = `\.txt$`
+	})
+	defer e.Close()
+	e.signIn(t)
+	e.f.AddFile("/docs/a&b=c #1.txt", "odd name")
+
+	list := func(c *http.Client, path string, h http.Header) listing {
+		resp, body := e.get(t, c, path, h)
+		var l listing
+		if err := json.Unmarshal([]byte(body), &l); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got %s %q", path, resp.Status, body)
+		}
+		return l
+	}
+	names := func(l listing) string {
+		var res []string
+		for _, v := range l.Items {
+			res = append(res, v.Name)
+		}
+		return strings.Join(res, ",")
+	}
+
+	// hidden items are only listed for the admin, marked as such
+	if got := names(list(e.client(false), "/?format=json", nil)); got != "builds,docs" {
+		t.Fatalf("a visitor got %s", got)
+	}
+	l := list(e.client(true), "/", http.Header{"Accept": {"application/json"}})
+	if l.Path != "/" || names(l) != "builds,docs,readme.md" || !l.Items[2].Hidden || l.Items[0].Hidden {
+		t.Fatalf("the admin got %+v", l)
+	}
+	if b := l.Items[0]; !b.Folder || b.ChildCount != 250 || b.Href != "/builds" || b.LastModifiedDateTime == "" {
+		t.Fatalf("got %+v for the builds folder", b)
+	}
+
+	// the file name is escaped in its link
+	l = list(e.client(false), "/docs/?format=json", nil)
+	if len(l.Items) != 2 || l.Items[0].Href != "?file=a%26b%3Dc+%231.txt" || l.Items[0].Size != 8 || l.Items[0].Folder {
+		t.Fatalf("got %+v in /docs", l.Items)
+	}
+	if _, body := e.get(t, e.client(false), "/docs/"+l.Items[0].Href, nil); body != "odd name" {
+		t.Fatalf("got %q from the escaped link", body)
+	}
+
+	for query, first := range map[string]string{
+		"c=n&o=d": "build-249.zip",
+		"c=s":     "build-000.zip",
+		"c=s&o=d": "build-249.zip",
+		"c=n":     "build-000.zip",
+	} {
+		if l := list(e.client(false), "/builds/?format=json&"+query, nil); len(l.Items) != 250 || l.Items[0].Name != first {
+			t.Errorf("%s: got %d items starting with %s, want %s", query, len(l.Items), l.Items[0].Name, first)
+		}
+	}
+}
+
+func TestInfoMasksTokens(t *testing.T) {
+	e := newTestEnv(t, nil)
+	defer e.Close()
+	e.signIn(t)
+
+	tk := e.m.one.tokens.Tokens()
+	_, body := e.get(t, e.client(true), "/?info", nil)
+	if strings.Contains(body, tk.Access) || strings.Contains(body, tk.Refresh) || strings.Contains(body, conf.ClientSecret) {
+		t.Fatal("the info page shows a token or secret")
+	}
+	if !strings.Contains(body, "Access: ******, expires ") {
+		t.Fatal("the info page doesn't say when the access token expires")
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.Prefetch = `\.txt$` })
+	defer e.Close()
+	e.signIn(t)
+	c := e.client(false)
+
+	var item *driveItem
+	for _, v := range e.m.backend.List(context.Background(), "/docs/").Values {
+		if v.Name == "hello.txt" {
+			item = v
+		}
+	}
+	if item == nil {
+		t.Fatal("hello.txt is not listed")
+	}
+	etag := itemETag(item)
+
+	// before the file is cached, ranges go upstream and validators are checked against the listing
+	resp, body := e.get(t, c, "/docs/?file=hello.txt", http.Header{"Range": {"bytes=0-4"}})
+	if resp.StatusCode != http.StatusPartialContent || body != "hello" {
+		t.Fatalf("got %s %q for a range, want 206 \"hello\"", resp.Status, body)
+	}
+	if _, err := os.Stat(cachePath(item)); err == nil {
+		t.Fatal("a partial body has been cached")
+	}
+	resp, _ = e.get(t, c, "/docs/?file=hello.txt", http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("got %s for a matching If-None-Match, want 304", resp.Status)
+	}
+
+	resp, body = e.get(t, c, "/docs/?file=hello.txt", nil)
+	if resp.StatusCode != http.StatusOK || body != "hello world\n" {
+		t.Fatalf("got %s %q, want the whole file", resp.Status, body)
+	}
+	if resp.Header.Get("ETag") != etag {
+		t.Fatalf("got ETag %s, want %s", resp.Header.Get("ETag"), etag)
+	}
+	if _, err := os.Stat(cachePath(item)); err != nil {
+		t.Fatal("the file has not been cached:", err)
+	}
+
+	// the cached copy answers ranges and validators itself, even once the file is gone upstream
+	e.f.Remove("/docs/hello.txt")
+	resp, body = e.get(t, c, "/docs/?file=hello.txt", http.Header{"Range": {"bytes=6-10"}})
+	if resp.StatusCode != http.StatusPartialContent || body != "world" {
+		t.Fatalf("got %s %q for a cached range, want 206 \"world\"", resp.Status, body)
+	}
+	resp, _ = e.get(t, c, "/docs/?file=hello.txt", http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("got %s for a matching If-None-Match on the cached file, want 304", resp.Status)
+	}
+	resp, body = e.get(t, c, "/docs/?file=hello.txt", http.Header{"If-None-Match": {`"other"`}})
+	if resp.StatusCode != http.StatusOK || body != "hello world\n" {
+		t.Fatalf("got %s %q for a stale If-None-Match, want the whole file", resp.Status, body)
+	}
+}
+
+func TestServeFileOpenRange(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.Prefetch = `\.txt$` })
+	defer e.Close()
+	e.signIn(t)
+
+	resp, body := e.get(t, e.client(false), "/docs/?file=hello.txt", http.Header{"Range": {"bytes=0-"}})
+	if resp.StatusCode/100 != 2 || body != "hello world\n" {
+		t.Fatalf("got %s %q for bytes=0-, want the whole file", resp.Status, body)
+	}
+	if files, _ := filepath.Glob("cache/*/*/*-hello.txt"); len(files) != 1 {
+		t.Fatal("the file has not been cached for bytes=0-")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.Prefetch = `\.txt$` })
+	defer e.Close()
+	e.signIn(t)
+	e.f.AddFile("/other/hello.txt", "other hello\n")
+
+	// files of the same name in different folders are cached apart
+	for path, content := range map[string]string{"/docs/": "hello world\n", "/other/": "other hello\n"} {
+		for i := 0; i < 2; i++ {
+			if _, body := e.get(t, e.client(false), path+"?file=hello.txt", nil); body != content {
+				t.Fatalf("got %q from %s, want %q", body, path, content)
+			}
+		}
+	}
+	if files, _ := filepath.Glob("cache/*/*/*-hello.txt"); len(files) != 2 {
+		t.Fatalf("%d cached copies of the two hello.txt", len(files))
+	}
+
+	// a new eTag is a new version, the older one is dropped when it is fetched
+	var item *driveItem
+	for _, v := range e.m.backend.List(context.Background(), "/docs/").Values {
+		if v.Name == "hello.txt" {
+			item = v
+		}
+	}
+	old := cachePath(item)
+	changed := *item
+	changed.ETag = `"{` + item.ID + `},2"`
+	if cachePath(&changed) == old || filepath.Dir(cachePath(&changed)) != filepath.Dir(old) {
+		t.Fatalf("%s for the new version of %s", cachePath(&changed), old)
+	}
+	stale := strings.Replace(old, filepath.Base(old)[:cacheKeyLen], filepath.Base(cachePath(&changed))[:cacheKeyLen], 1)
+	if err := os.Rename(old, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := e.get(t, e.client(false), "/docs/?file=hello.txt", nil); body != "hello world\n" {
+		t.Fatalf("got %q after the version changed", body)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatal("the older version is still cached")
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Fatal("the current version has not been cached:", err)
+	}
+}
+
+func TestPrefetchConcurrentMisses(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.Prefetch = `\.zip$` })
+	defer e.Close()
+	e.signIn(t)
+	content := strings.Repeat("x", 249)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", e.srv.URL+"/builds/?file=build-249.zip", nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if buf, _ := ioutil.ReadAll(resp.Body); string(buf) != content {
+				t.Errorf("got %s with %d bytes, want %d", resp.Status, len(buf), len(content))
+			}
+		}()
+	}
+	wg.Wait()
+
+	files, _ := filepath.Glob("cache/*/*/*-build-249.zip")
+	tmp, _ := filepath.Glob("cache/*/*/.tmp-*")
+	if len(files) != 1 || len(tmp) != 0 {
+		t.Fatalf("cached %v and temp files %v, want build-249.zip once", files, tmp)
+	}
+}
+
+func TestPrefetchSlowDownload(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.Prefetch = `\.zip$` })
+	defer e.Close()
+	e.signIn(t)
+
+	// the download takes longer than any Graph request may
+	e.f.SlowDownloads(2500 * time.Millisecond)
+	resp, body := e.get(t, e.client(false), "/builds/?file=build-200.zip", nil)
+	if resp.StatusCode != http.StatusOK || body != strings.Repeat("x", 200) {
+		t.Fatalf("got %s with %d bytes from a slow download, want 200", resp.Status, len(body))
+	}
+	if files, _ := filepath.Glob("cache/*/*/*-build-200.zip"); len(files) != 1 {
+		t.Fatal("the slow download has not been cached")
+	}
+}
+
+func TestPrefetchIncomplete(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.Prefetch = `\.txt$` })
+	defer e.Close()
+	e.signIn(t)
+
+	// the listing promises more bytes than the download has, so the download is incomplete
+	for _, v := range e.m.backend.List(context.Background(), "/docs/").Values {
+		if v.Name == "hello.txt" {
+			v.Size = 100
+		}
+	}
+	e.get(t, e.client(false), "/docs/?file=hello.txt", nil)
+	if files, _ := filepath.Glob("cache/*/*/*-hello.txt"); len(files) != 0 {
+		t.Fatalf("cached %v from an incomplete download", files)
+	}
+}
+
+func TestSearchPage(t *testing.T) {
+	e := newTestEnv(t, func(c *config) {
+		c.Ignore = `^docs$`
+		c.Prefetch = `\.txt$`
+	})
+	defer e.Close()
+	e.signIn(t)
+
+	search := func(c *http.Client, path string) []listItem {
+		resp, body := e.get(t, c, path, http.Header{"Accept": {"application/json"}})
+		var list listing
+		if err := json.Unmarshal([]byte(body), &list); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got %s %q", path, resp.Status, body)
+		}
+		return list.Items
+	}
+
+	if items := search(e.client(false), "/?q=hello"); len(items) != 0 {
+		t.Fatalf("a visitor found %+v inside an ignored folder", items)
+	}
+	items := search(e.client(true), "/builds/?q=hello")
+	if len(items) != 1 || items[0].Name != "docs/hello.txt" || !items[0].Hidden || items[0].Href != "/docs/?file=hello.txt" {
+		t.Fatalf("the admin found %+v, want the hidden docs/hello.txt from the root", items)
+	}
+	if _, body := e.get(t, e.client(true), items[0].Href, nil); body != "hello world\n" {
+		t.Fatalf("got %q from the result's link", body)
+	}
+
+	if items := search(e.client(false), "/?q=BUILD-24&c=n&o=d"); len(items) != 10 || items[0].Name != "builds/build-249.zip" {
+		t.Fatalf("got %d results, want build-249.zip to build-240.zip", len(items))
+	}
+}
+
+func TestListingConcurrentRequests(t *testing.T) {
+	e := newTestEnv(t, func(c *config) {
+		c.Ignore = `-00[0-9]\.zip$`
+		c.CacheDir = "listings"
+	})
+	defer e.Close()
+	e.signIn(t)
+
+	// every request sorts and marks the same cached listing its own way
+	paths := []string{"/builds/?c=n&o=d", "/builds/?c=s", "/builds/?c=t&o=d", "/builds/?format=json", "/builds/"}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				resp, _ := e.get(t, e.client(j%2 == 0), path, nil)
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("%s: %s", path, resp.Status)
+				}
+			}
+		}(paths[i%len(paths)])
+	}
+	wg.Wait()
+
+	x := e.m.backend.List(context.Background(), "/builds/")
+	for i, v := range x.Values {
+		if v.isHidden || v.Name != fmt.Sprintf("build-%03d.zip", i) {
+			t.Fatalf("the cached listing has been changed by a request, item %d is %s", i, v.Name)
+		}
+	}
+}
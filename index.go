@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	indexInterval = time.Hour
+	indexRetry    = time.Minute
+	// indexPause spaces out the listings of a crawl so it doesn't compete with visitors for the Graph quota
+	indexPause   = 100 * time.Millisecond
+	recentPrefix = "recent:"
+	recentDays   = 7
+	indexResults = 1000
+)
+
+// indexEntry is an item found by the crawler, Dir is its folder inside the drive, like / or /a/b
+type indexEntry struct {
+	Dir        string
+	Name       string
+	Folder     bool
+	ChildCount int
+	Size       int
+	Created    string
+	Modified   string
+	ETag       string
+}
+
+type indexFile struct {
+	Built   time.Time
+	Entries []indexEntry
+}
+
+// searchIndex is a list of every item of a drive, kept in a file and refreshed by a background crawler
+type searchIndex struct {
+	m        *mount
+	file     string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	built   time.Time
+	entries []indexEntry
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSearchIndex(m *mount) *searchIndex {
+	ix := &searchIndex{
+		m:        m,
+		file:     m.conf.IndexFile,
+		interval: time.Duration(m.conf.IndexInterval) * time.Second,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if ix.interval <= 0 {
+		ix.interval = indexInterval
+	}
+
+	if f, err := os.Open(ix.file); err == nil {
+		v := &indexFile{}
+		if err := gob.NewDecoder(f).Decode(v); err != nil {
+			log.Println("Index", ix.file, "is unreadable and will be rebuilt:", err)
+		} else {
+			ix.built, ix.entries = v.Built, v.Entries
+			log.Println("Index:", "/"+m.Prefix, len(v.Entries), "items, built", v.Built.Format(time.RFC3339))
+		}
+		f.Close()
+	}
+
+	go ix.run()
+	return ix
+}
+
+func (ix *searchIndex) ready() bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return !ix.built.IsZero()
+}
+
+func (ix *searchIndex) run() {
+	defer close(ix.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-ix.stop
+		cancel()
+	}()
+
+	ix.mu.RLock()
+	wait := time.Until(ix.built.Add(ix.interval))
+	ix.mu.RUnlock()
+	for {
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-time.After(wait):
+		case <-ix.stop:
+			return
+		}
+
+		start := time.Now()
+		wait = ix.interval
+		if n, listed, err := ix.crawl(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("Index", "/"+ix.m.Prefix, "crawl failed:", err)
+			if wait > indexRetry {
+				wait = indexRetry
+			}
+		} else {
+			log.Println("Index", "/"+ix.m.Prefix, n, "items,", listed, "folders listed in", time.Since(start).Truncate(time.Millisecond))
+		}
+	}
+}
+
+// crawl lists the drive from the root and replaces the index when done. On personal OneDrive the
+// eTag of a folder changes whenever anything below it changes, so folders with the eTag of the
+// previous crawl are copied from the old index instead of being listed again. OneDrive for Business
+// and SharePoint don't promise that, their folders are always listed.
+func (ix *searchIndex) crawl(ctx context.Context) (int, int, error) {
+	ix.mu.RLock()
+	old, prev := map[string][]indexEntry{}, map[string]indexEntry{}
+	for _, e := range ix.entries {
+		old[e.Dir] = append(old[e.Dir], e)
+		if e.Folder {
+			prev[path.Join(e.Dir, e.Name)] = e
+		}
+	}
+	ix.mu.RUnlock()
+
+	var entries []indexEntry
+	var reuse func(dir string)
+	reuse = func(dir string) {
+		for _, e := range old[dir] {
+			entries = append(entries, e)
+			if e.Folder {
+				reuse(path.Join(dir, e.Name))
+			}
+		}
+	}
+
+	listed, queue := 0, []string{"/"}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		listPath := dir
+		if dir != "/" {
+			listPath += "/"
+		}
+		x := ix.list(ctx, listPath)
+		if x.Error.Message != "" {
+			return 0, listed, fmt.Errorf("%s: %s", dir, x.Error.Message)
+		}
+		listed++
+
+		for _, v := range x.Values {
+			e := indexEntry{
+				Dir:      dir,
+				Name:     v.Name,
+				Folder:   v.Folder != nil,
+				Size:     v.Size,
+				Created:  v.CreatedDateTime,
+				Modified: v.LastModifiedDateTime,
+				ETag:     v.ETag,
+			}
+			if v.Folder != nil {
+				e.ChildCount = v.Folder.ChildCount
+			}
+			entries = append(entries, e)
+			if !e.Folder {
+				continue
+			}
+
+			child := path.Join(dir, e.Name)
+			personal := ix.m.one != nil && v.ParentReference.DriveType == "personal"
+			if p, ok := prev[child]; ok && personal && e.ETag != "" && p.ETag == e.ETag {
+				reuse(child)
+			} else {
+				queue = append(queue, child)
+			}
+		}
+
+		select {
+		case <-time.After(indexPause):
+		case <-ctx.Done():
+			return 0, listed, ctx.Err()
+		}
+	}
+
+	built := time.Now()
+	ix.mu.Lock()
+	ix.built, ix.entries = built, entries
+	ix.mu.Unlock()
+	return len(entries), listed, ix.save(&indexFile{Built: built, Entries: entries})
+}
+
+// list reads a folder for the crawler past the listing cache, so a crawl neither evicts the listings
+// visitors use nor fills CacheDir
+func (ix *searchIndex) list(ctx context.Context, path string) *driveItems {
+	if ix.m.one != nil {
+		return ix.m.one.fetchList(ctx, path)
+	}
+	return ix.m.backend.List(ctx, path)
+}
+
+func (ix *searchIndex) save(v *indexFile) error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	return writeFileAtomic(ix.file, buf.Bytes(), 0600)
+}
+
+// Search matches q against the names in the index, ignoring case: q with wildcards is a glob,
+// anything else a substring. recent:N lists the files changed in the last N days instead.
+func (ix *searchIndex) Search(q string) (x *driveItems) {
+	x = &driveItems{}
+
+	match := func(e *indexEntry) bool { return strings.Contains(strings.ToLower(e.Name), strings.ToLower(q)) }
+	if strings.HasPrefix(q, recentPrefix) {
+		days, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(q, recentPrefix)))
+		if err != nil || days <= 0 {
+			days = recentDays
+		}
+		since := time.Now().AddDate(0, 0, -days).UTC().Format(time.RFC3339)
+		match = func(e *indexEntry) bool { return !e.Folder && e.Modified >= since }
+	} else if strings.ContainsAny(q, "*?[") {
+		pattern := strings.ToLower(q)
+		if _, err := path.Match(pattern, ""); err != nil {
+			x.Error.Message = "Bad pattern: " + q
+			return
+		}
+		match = func(e *indexEntry) bool {
+			ok, _ := path.Match(pattern, strings.ToLower(e.Name))
+			return ok
+		}
+	}
+
+	ix.mu.RLock()
+	for i := range ix.entries {
+		if e := &ix.entries[i]; match(e) {
+			x.Values = append(x.Values, e.item())
+		}
+	}
+	x.ts = ix.built.Unix()
+	ix.mu.RUnlock()
+
+	if len(x.Values) > indexResults {
+		// keep the latest changes
+		sort.Slice(x.Values, func(i, j int) bool { return x.Values[i].LastModifiedDateTime > x.Values[j].LastModifiedDateTime })
+		x.Values = x.Values[:indexResults]
+		x.warning = fmt.Sprintf("Only the %d most recently changed matches are shown", indexResults)
+	}
+	return
+}
+
+func (e *indexEntry) item() *driveItem {
+	item := &driveItem{
+		Name:                 e.Name,
+		Size:                 e.Size,
+		CreatedDateTime:      e.Created,
+		LastModifiedDateTime: e.Modified,
+		ETag:                 e.ETag,
+	}
+	item.ParentReference.Path = e.Dir
+	if e.Folder {
+		item.Folder = &_folder{ChildCount: e.ChildCount}
+	}
+	return item
+}
+
+// Close stops the crawler, a crawl in progress is abandoned
+func (ix *searchIndex) Close() {
+	close(ix.stop)
+	<-ix.done
+}
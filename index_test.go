@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSearchIndex(t *testing.T) {
+	e := newTestEnv(t, func(c *config) {
+		c.IndexFile = "test.index"
+		c.IndexInterval = 3600
+	})
+	defer e.Close()
+	e.signIn(t)
+	e.m.start()
+	waitFor(t, "the first crawl", e.m.index.ready)
+
+	search := func(ix *searchIndex, q string) string {
+		x := ix.Search(q)
+		if x.Error.Message != "" {
+			return x.Error.Message
+		}
+		var res []string
+		for _, v := range x.Values {
+			res = append(res, v.ParentReference.Path+"/"+v.Name)
+		}
+		sort.Strings(res)
+		return strings.Join(res, ",")
+	}
+	var builds []string
+	for i := 0; i < 10; i++ {
+		builds = append(builds, fmt.Sprintf("/builds/build-00%d.zip", i))
+	}
+	for _, c := range []struct{ q, want string }{
+		{"HELLO", "/docs/hello.txt"},
+		{"ocs", "//docs"},
+		{"build-00?.zip", strings.Join(builds, ",")},
+		{"*.MD", "//readme.md"},
+		{"[", "Bad pattern: ["},
+		{"recent:", ""},
+	} {
+		if got := search(e.m.index, c.q); got != c.want {
+			t.Errorf("%q finds %q, want %q", c.q, got, c.want)
+		}
+	}
+
+	// /builds keeps its eTag and is copied from the last crawl, it would fail if it were listed
+	e.f.AddFile("/docs/new.txt", "new")
+	e.f.Fail("/builds", http.StatusInternalServerError)
+	n, listed, err := e.m.index.crawl(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 255 || listed != 2 {
+		t.Fatalf("crawled %d items in %d listings, want 255 in 2", n, listed)
+	}
+	if got := search(e.m.index, "recent:1"); got != "/docs/new.txt" {
+		t.Fatalf("recent:1 finds %q", got)
+	}
+	if got := len(e.m.index.Search("build-").Values); got != 250 {
+		t.Fatalf("found %d builds after the crawl", got)
+	}
+
+	// the saved index is read back by the next start, without a crawl
+	e.m.Close()
+	mounts = nil
+	if tmp, _ := filepath.Glob("test.index.tmp-*"); len(tmp) != 0 {
+		t.Fatalf("%v left behind", tmp)
+	}
+	e.f.Fail("", http.StatusInternalServerError)
+	ix := newSearchIndex(e.m)
+	defer ix.Close()
+	if !ix.ready() {
+		t.Fatal("the index file has not been loaded")
+	}
+	if got := search(ix, "new.txt"); got != "/docs/new.txt" {
+		t.Fatalf("the loaded index finds %q", got)
+	}
+}
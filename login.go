@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type deviceCode struct {
+	DeviceCode      string      `json:"device_code"`
+	UserCode        string      `json:"user_code"`
+	VerificationURI string      `json:"verification_uri"`
+	ExpiresIn       interface{} `json:"expires_in"`
+	Interval        interface{} `json:"interval"`
+	Message         string      `json:"message"`
+	Error           string      `json:"error"`
+	Description     string      `json:"error_description"`
+}
+
+// postForm sends a form to the token service and decodes the JSON answer into v
+func postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) ([]byte, error) {
+	req, _ := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return nil, fmt.Errorf("%s: %v", resp.Status, err)
+	}
+	return buf, nil
+}
+
+// DeviceLogin signs in with the device code flow, the user completes it on any other device.
+// The app registration must allow public client flows.
+func (o *oneManager) DeviceLogin(ctx context.Context) error {
+	form := url.Values{}
+	form.Add("client_id", o.client.id)
+	form.Add("scope", o.conf.graphScopes(o.conf.scopes()))
+
+	dc := &deviceCode{}
+	if _, err := postForm(ctx, o.conf.LoginURL+"/devicecode", form, dc); err != nil {
+		return err
+	}
+	if dc.Error != "" {
+		return fmt.Errorf("%s: %s", dc.Error, dc.Description)
+	}
+
+	if dc.Message != "" {
+		fmt.Println(dc.Message)
+	} else {
+		fmt.Printf("To sign in, open %s and enter the code %s\n", dc.VerificationURI, dc.UserCode)
+	}
+
+	interval, expires := time.Duration(jsonInt(dc.Interval))*time.Second, jsonInt(dc.ExpiresIn)
+	if interval < time.Second {
+		interval = 5 * time.Second
+	}
+	if expires <= 0 {
+		expires = 900
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(expires)*time.Second)
+	defer cancel()
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return fmt.Errorf("the code has expired, please try again")
+		}
+
+		form := url.Values{}
+		form.Add("client_id", o.client.id)
+		form.Add("device_code", dc.DeviceCode)
+		form.Add("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+
+		e := &deviceCode{}
+		buf, err := postForm(ctx, o.conf.LoginURL+"/token", form, e)
+		if err != nil {
+			log.Println("Device login:", err)
+			continue
+		}
+
+		switch e.Error {
+		case "":
+			t := parseToken(buf)
+			if t.Access == "" || t.Refresh == "" {
+				return fmt.Errorf("no tokens in the answer")
+			}
+			t.Public = true
+			o.tokens.Set(t)
+			o.checkScopes()
+			return nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return fmt.Errorf("%s: %s", e.Error, e.Description)
+		}
+	}
+}
+
+// login runs `gone login [mount]`, which signs in a drive in the terminal and stores its tokens
+func login(args []string) error {
+	var candidates []*mount
+	for _, m := range mounts {
+		if m.one == nil || m.conf.appOnly() {
+			continue
+		}
+		if len(args) == 0 || m.Prefix == args[0] {
+			candidates = append(candidates, m)
+		}
+	}
+
+	switch {
+	case len(candidates) == 0 && len(args) > 0:
+		return fmt.Errorf("No OneDrive mounted at %s", args[0])
+	case len(candidates) == 0:
+		return fmt.Errorf("No drive needs a sign-in")
+	case len(candidates) > 1:
+		return fmt.Errorf("Please choose the drive to sign in: gone login <mount>")
+	}
+
+	m := candidates[0]
+	if err := m.one.DeviceLogin(context.Background()); err != nil {
+		return err
+	}
+	log.Println("Tokens saved to", m.conf.TokenFile)
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDeviceLogin(t *testing.T) {
+	e := newTestEnv(t, nil)
+	defer e.Close()
+
+	if err := login([]string{"nope"}); err == nil || !strings.Contains(err.Error(), "No OneDrive mounted at nope") {
+		t.Fatalf("got %v for an unknown mount", err)
+	}
+
+	// the fake approves the code on the second poll
+	if err := login(nil); err != nil {
+		t.Fatal(err)
+	}
+	tk := e.m.one.tokens.Tokens()
+	if !tk.Public || !strings.HasPrefix(tk.Refresh, "refresh-") {
+		t.Fatalf("got tokens %+v after the device login", tk)
+	}
+	if _, err := os.Stat(conf.TokenFile); err != nil {
+		t.Fatal("the tokens have not been saved:", err)
+	}
+
+	// the tokens are refreshed as a public client too
+	e.f.Expire()
+	if x := e.m.backend.List(context.Background(), "/docs/"); x.Error.Message != "" {
+		t.Fatal(x.Error.Message)
+	}
+	if after := e.m.one.tokens.Tokens(); !after.Public || after.Refresh == tk.Refresh {
+		t.Fatalf("got tokens %+v after a refresh", after)
+	}
+}
@@ -1,31 +1,63 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	_ "image/jpeg"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coyove/common/lru"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var listen = flag.String("l", ":8080", "Listening address")
 var configfile = flag.String("c", "", "Config file to load")
-var o *oneManager
+var hashpw = flag.Bool("hash", false, "Read a password from stdin and print its bcrypt hash for the config")
+var conf *config
+var prefetch *lru.Cache
+
+// jsonInt reads a number which some token endpoints send as a string
+func jsonInt(v interface{}) int64 {
+	switch v := v.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
 
-func parseToken(buf []byte) (string, string) {
+func parseToken(buf []byte) *tokens {
 	m := map[string]interface{}{}
 	json.Unmarshal(buf, &m)
-	a, _ := m["access_token"].(string)
-	r, _ := m["refresh_token"].(string)
-	return a, r
+	t := &tokens{Refreshed: time.Now().Unix()}
+	t.Access, _ = m["access_token"].(string)
+	t.Refresh, _ = m["refresh_token"].(string)
+	if sec := jsonInt(m["expires_in"]); sec > 0 {
+		t.Expires = t.Refreshed + sec
+	}
+	if sec := jsonInt(m["ext_expires_in"]); sec > 0 {
+		t.ExtExpires = t.Refreshed + sec
+	}
+	if scope, _ := m["scope"].(string); scope != "" {
+		t.Scopes = strings.Fields(scope)
+	}
+	return t
 }
 
 func prettySize(size int) string {
@@ -41,6 +73,14 @@ func prettySize(size int) string {
 	return strconv.FormatFloat(float64(size)/1024/1024/1024, 'f', 1, 64) + "G"
 }
 
+// displaySize shows the child count for folders and the pretty size for files
+func displaySize(item *driveItem) string {
+	if item.Folder != nil {
+		return "(" + strconv.Itoa(item.Folder.ChildCount) + ")"
+	}
+	return prettySize(item.Size)
+}
+
 func strlen(s string) int {
 	ln := 0.0
 	for _, r := range s {
@@ -57,6 +97,16 @@ func main() {
 	flag.Parse()
 	log.SetFlags(log.Lshortfile | log.Lmicroseconds | log.Ldate)
 
+	if *hashpw {
+		pw, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(pw, "\r\n")), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(string(hash))
+		return
+	}
+
 	if *configfile == "" {
 		log.Fatalln("Please specify the config file")
 	}
@@ -66,7 +116,7 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	conf := &config{}
+	conf = &config{}
 	if err := json.Unmarshal(configbuf, conf); err != nil {
 		log.Fatalln(err)
 	}
@@ -74,15 +124,18 @@ func main() {
 	if conf.Password == "" {
 		log.Fatalln("Please specify a admin password")
 	}
-	if conf.ClientID == "" {
-		log.Fatalln("Please specify a client ID")
+	if !strings.HasPrefix(conf.Password, "$2") {
+		log.Println("The admin password is stored in plain text, use -hash to generate a bcrypt hash")
 	}
-	if conf.ClientSecret == "" {
-		log.Fatalln("Please specify a client secret")
-	}
-	conf.redir, err = url.Parse(conf.RedirURL)
-	if err != nil {
-		log.Fatalln(err)
+	initSessions()
+
+	if len(conf.Drives) == 0 {
+		if err := conf.check(); err != nil {
+			log.Fatalln(err)
+		}
+	} else if conf.Ignore != "" {
+		// the top Ignore rule hides mounts in the combined root
+		conf.ignoreRegex = regexp.MustCompile(conf.Ignore)
 	}
 
 	if conf.Header != "" {
@@ -95,54 +148,125 @@ func main() {
 		conf.Footer = string(buf)
 	}
 
-	if conf.Ignore != "" {
-		conf.ignoreRegex = regexp.MustCompile(conf.Ignore)
+	if err := initMounts(); err != nil {
+		log.Fatalln(err)
 	}
 
-	if conf.Prefetch != "" {
-		conf.prefetchRegex = regexp.MustCompile(conf.Prefetch)
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "login":
+			if err := login(args[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		default:
+			log.Fatalln("Unknown command:", args[0])
+		}
+		return
 	}
 
-	o = newOneManager(conf)
+	prefetch = lru.NewCache(int64(conf.PrefetchSize) * 1024 * 1024)
+	prefetch.OnEvicted = func(k lru.Key, v interface{}) {
+		go func() {
+			time.Sleep(time.Second)
+			os.Remove(k.(string))
+		}()
+	}
 
 	os.Mkdir("cache", 0755)
 	log.Println("Make cache dir: ./cache")
 
-	if o.prefetch != nil {
-		prefetched := int64(0)
-		log.Println("Counting prefetched")
-		filepath.Walk("cache", func(path string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				return nil
-			}
+	prefetched, legacy := int64(0), 0
+	log.Println("Counting prefetched")
+	filepath.Walk("cache", func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
 
-			name := info.Name()
-			switch strings.ToLower(name[strings.LastIndex(name, "-")+1:]) {
-			case "readme.md", "readme", "readme.txt", "readme.htm", "readme.html":
-				os.Remove(path)
-				return nil
-			}
+		name := info.Name()
+		if len(name) < cacheKeyLen || name[cacheKeyLen-10] != '.' || name[cacheKeyLen-1] != '-' {
+			// files cached by older versions are keyed on the bare name and may belong to any folder,
+			// .tmp- files are downloads interrupted by a restart
+			os.Remove(path)
+			legacy++
+			return nil
+		}
 
-			prefetched += info.Size()
-			o.prefetch.AddWeight(path, true, info.Size())
+		switch strings.ToLower(name[cacheKeyLen:]) {
+		case "readme.md", "readme", "readme.txt", "readme.htm", "readme.html":
+			os.Remove(path)
 			return nil
-		})
-		log.Println("Prefetched:", prefetched, "bytes")
-	}
+		}
+
+		prefetched += info.Size()
+		prefetch.AddWeight(path, true, info.Size())
+		return nil
+	})
+	log.Println("Prefetched:", prefetched, "bytes, discarded", legacy, "legacy files")
 
-	http.HandleFunc("/authcallback", o.GetTokenCallback)
+	callbacks := map[string]bool{}
+	for _, m := range mounts {
+		if m.one != nil && !m.conf.appOnly() && !callbacks[m.conf.redir.Path] {
+			callbacks[m.conf.redir.Path] = true
+			http.HandleFunc(m.conf.redir.Path, AuthCallback)
+		}
+	}
+	notifies := map[string]bool{}
+	for _, m := range mounts {
+		if m.one != nil && m.conf.notify != nil && !notifies[m.conf.notify.Path] {
+			notifies[m.conf.notify.Path] = true
+			http.HandleFunc(m.conf.notify.Path, Notify)
+		}
+	}
 	http.HandleFunc("/", Main)
+	if conf.WebDAVPrefix != "" {
+		conf.WebDAVPrefix = "/" + strings.Trim(conf.WebDAVPrefix, "/")
+		if conf.WebDAVPrefix == "/" {
+			log.Fatalln("WebDAV prefix cannot be the root")
+		}
+		http.HandleFunc(conf.WebDAVPrefix+"/", WebDAV)
+		log.Println("WebDAV:", conf.WebDAVPrefix+"/")
+	}
+
+	// listen before the mounts start, Graph checks the notification URL when subscribing
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, m := range mounts {
+		m.start()
+	}
 
 	log.Println("Hello", *listen)
 
-	if _, err := os.Stat(conf.ClientID + ".token"); err != nil {
-		fmt.Println()
-		fmt.Println("***********************************************************")
-		fmt.Println("*     If this is your first time running gone server      *")
-		fmt.Println("* Follow the belowed URL to sign in the Microsoft account *")
-		fmt.Println("***********************************************************")
-		fmt.Println("https://" + conf.redir.Hostname() + "/?auth=" + conf.Password)
-		fmt.Println()
+	for _, m := range mounts {
+		if m.one != nil && !m.conf.appOnly() && m.one.tokens.Tokens().Refresh == "" {
+			fmt.Println()
+			fmt.Println("***********************************************************")
+			fmt.Println("*     If this is your first time running gone server      *")
+			fmt.Println("* Follow the belowed URL to sign in the Microsoft account *")
+			fmt.Println("***********************************************************")
+			fmt.Println("https://" + m.conf.redir.Hostname() + strings.TrimSuffix("/"+m.Prefix, "/") + "/?auth")
+			fmt.Println(strings.TrimSpace("or sign in from the terminal: gone -c " + *configfile + " login " + m.Prefix))
+			fmt.Println()
+		}
+	}
+
+	srv := &http.Server{}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
+	for _, m := range mounts {
+		m.Close()
 	}
-	http.ListenAndServe(*listen, nil)
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coyove/common/lru"
+)
+
+// testEnv runs gone with a single drive on a fake Graph, like main does with a config file
+type testEnv struct {
+	f   *fakeGraph
+	srv *httptest.Server
+	m   *mount
+	dir string
+	wd  string
+}
+
+// newTestEnv starts gone in a temp dir, which also holds ./cache, setup may change the config before it is checked
+func newTestEnv(t *testing.T, setup func(c *config)) *testEnv {
+	dir, err := ioutil.TempDir("", "gone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &testEnv{f: newFakeGraph(), dir: dir, wd: wd}
+	mux := http.NewServeMux()
+	e.srv = httptest.NewServer(mux)
+
+	conf = &config{
+		ClientID:     "test-client",
+		ClientSecret: "test-secret",
+		RedirURL:     e.srv.URL + "/callback",
+		Password:     "test",
+		GraphURL:     e.f.URL + "/v1.0",
+		LoginURL:     e.f.URL + "/common/oauth2/v2.0",
+		TokenFile:    filepath.Join(dir, "test.token"),
+	}
+	if setup != nil {
+		setup(conf)
+	}
+	initSessions()
+	if err := conf.check(); err != nil {
+		e.Close()
+		t.Fatal(err)
+	}
+	mounts = nil
+	rootCache.Lock()
+	rootCache.x = nil
+	rootCache.Unlock()
+	if err := initMounts(); err != nil {
+		e.Close()
+		t.Fatal(err)
+	}
+	e.m = mounts[0]
+	prefetch = lru.NewCache(64 * 1024 * 1024)
+
+	mux.HandleFunc(conf.redir.Path, AuthCallback)
+	if conf.notify != nil {
+		mux.HandleFunc(conf.notify.Path, Notify)
+	}
+	if conf.WebDAVPrefix != "" {
+		mux.HandleFunc(conf.WebDAVPrefix+"/", WebDAV)
+	}
+	mux.HandleFunc("/", Main)
+	return e
+}
+
+func (e *testEnv) Close() {
+	for _, m := range mounts {
+		if m.one != nil {
+			m.one.Close()
+		}
+	}
+	mounts = nil
+	e.srv.Close()
+	e.f.Close()
+	os.Chdir(e.wd)
+	os.RemoveAll(e.dir)
+}
+
+// client returns a browser with its own cookies, signed in as the admin if admin is set
+func (e *testEnv) client(admin bool) *http.Client {
+	jar, _ := cookiejar.New(nil)
+	if admin {
+		u, _ := url.Parse(e.srv.URL)
+		expire := time.Now().Add(time.Hour).Unix()
+		jar.SetCookies(u, []*http.Cookie{{Name: sessionCookie, Value: signSession(expire), Path: "/"}})
+	}
+	return &http.Client{Jar: jar, Timeout: 10 * time.Second}
+}
+
+// signIn authorizes the drive the way the admin does in the browser, with /?auth
+func (e *testEnv) signIn(t *testing.T) {
+	resp, err := e.client(true).Get(e.srv.URL + "/?auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || e.m.one.tokens.Tokens().Refresh == "" {
+		t.Fatalf("sign-in ended with %s and no tokens", resp.Status)
+	}
+}
+
+// get requests path from gone with the headers in h, the body is returned as a string
+func (e *testEnv) get(t *testing.T, c *http.Client, path string, h http.Header) (*http.Response, string) {
+	req, _ := http.NewRequest("GET", e.srv.URL+path, nil)
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(buf)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mount is a drive published under /Prefix, the only drive of a config without Drives has an empty prefix
+type mount struct {
+	Prefix  string
+	conf    *config
+	backend Backend
+	one     *oneManager
+	index   *searchIndex
+}
+
+var mounts []*mount
+
+// hidden tells if name matches the Ignore rule of m, the combined root (m == nil) uses the top config
+func (m *mount) hidden(name string) bool {
+	c := conf
+	if m != nil {
+		c = m.conf
+	}
+	return c.ignoreRegex != nil && c.ignoreRegex.MatchString(name)
+}
+
+// served tells if the file is served by gone itself rather than redirected to the drive
+func (m *mount) served(name string) bool {
+	if m == nil {
+		return false
+	}
+	_, local := m.backend.(localFiler)
+	return local || m.conf.prefetchRegex != nil && m.conf.prefetchRegex.MatchString(name)
+}
+
+// inherit fills the empty settings of a drive from the top config, Ignore and Prefetch are per drive
+func (c *config) inherit(top *config) {
+	if c.Backend == "" {
+		c.Backend = top.Backend
+	}
+	if c.AuthMode == "" {
+		c.AuthMode = top.AuthMode
+	}
+	if c.ClientID == "" {
+		c.ClientID, c.ClientSecret, c.ClientCertificate = top.ClientID, top.ClientSecret, top.ClientCertificate
+	}
+	if c.RedirURL == "" {
+		c.RedirURL = top.RedirURL
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = top.Scopes
+	}
+	if c.TokenFile == "" {
+		c.TokenFile = c.ClientID + "." + strings.Trim(c.Mount, "/") + ".token"
+	}
+	if c.TokenKey == "" {
+		c.TokenKey = top.TokenKey
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = top.CacheSize
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = top.CacheTTL
+	}
+	if c.CacheDir == "" && top.CacheDir != "" {
+		c.CacheDir = filepath.Join(top.CacheDir, strings.Trim(c.Mount, "/"))
+	}
+	if c.PageSize == 0 {
+		c.PageSize = top.PageSize
+	}
+	if c.IndexFile == "" && top.IndexFile != "" {
+		c.IndexFile = top.IndexFile + "." + strings.Trim(c.Mount, "/")
+	}
+	if c.IndexInterval == 0 {
+		c.IndexInterval = top.IndexInterval
+	}
+	if c.DeltaInterval == 0 {
+		c.DeltaInterval = top.DeltaInterval
+	}
+	if c.NotifyURL == "" {
+		c.NotifyURL = top.NotifyURL
+	}
+	if c.Cloud == "" {
+		c.Cloud = top.Cloud
+	}
+	if c.Tenant == "" {
+		c.Tenant = top.Tenant
+	}
+	if c.AuthorityHost == "" {
+		c.AuthorityHost = top.AuthorityHost
+	}
+	if c.GraphHost == "" {
+		c.GraphHost = top.GraphHost
+	}
+	if c.GraphURL == "" {
+		c.GraphURL = top.GraphURL
+	}
+	if c.LoginURL == "" {
+		c.LoginURL = top.LoginURL
+	}
+}
+
+// appOnly tells if the drive is accessed with the app's own identity instead of a signed-in account
+func (c *config) appOnly() bool {
+	return c.AuthMode == "app"
+}
+
+// check validates the backend settings of c and compiles its rules
+func (c *config) check() error {
+	var err error
+	switch c.Backend {
+	case "", "onedrive":
+		if c.ClientID == "" {
+			return fmt.Errorf("Please specify a client ID")
+		}
+		if c.ClientCertificate != "" {
+			if c.clientCert, c.clientKey, err = loadClientCertificate(c.ClientCertificate); err != nil {
+				return err
+			}
+		} else if c.ClientSecret == "" {
+			return fmt.Errorf("Please specify a client secret or certificate")
+		}
+		if c.redir, err = url.Parse(c.RedirURL); err != nil {
+			return err
+		}
+		if !c.appOnly() {
+			if err := checkHandlerPath("RedirURL", c.redir.Path); err != nil {
+				return err
+			}
+		}
+		if err := c.resolveEndpoints(); err != nil {
+			return err
+		}
+
+		switch c.AuthMode {
+		case "", "delegated":
+		case "app":
+			switch strings.ToLower(c.Tenant) {
+			case "common", "organizations", "consumers":
+				return fmt.Errorf("App-only access needs a tenant ID")
+			}
+			if c.UserID == "" && c.DriveID == "" && c.SiteID == "" {
+				return fmt.Errorf("App-only access needs a UserID, DriveID or SiteID")
+			}
+			if c.SharedWithMe {
+				return fmt.Errorf("SharedWithMe cannot be used with app-only access")
+			}
+		default:
+			return fmt.Errorf("Unknown auth mode: %s", c.AuthMode)
+		}
+
+		n := 0
+		for _, set := range []bool{c.DriveID != "", c.SiteID != "", c.UserID != "", c.SharedWithMe} {
+			if set {
+				n++
+			}
+		}
+		if n > 1 {
+			return fmt.Errorf("DriveID, SiteID, UserID and SharedWithMe cannot be used together")
+		}
+		if c.CacheDir != "" {
+			// ./cache holds the prefetched files, anything else in it is removed at startup
+			if d := filepath.ToSlash(filepath.Clean(c.CacheDir)); d == "cache" || strings.HasPrefix(d, "cache/") {
+				return fmt.Errorf("CacheDir cannot be inside ./cache")
+			}
+		}
+		if c.NotifyURL != "" {
+			if c.notify, err = url.Parse(c.NotifyURL); err != nil {
+				return err
+			}
+			if err := checkHandlerPath("NotifyURL", c.notify.Path); err != nil {
+				return err
+			}
+			if c.notify.Path == c.redir.Path {
+				return fmt.Errorf("NotifyURL and RedirURL cannot have the same path")
+			}
+			if c.SharedWithMe {
+				return fmt.Errorf("NotifyURL cannot be used with SharedWithMe")
+			}
+		}
+		if c.RootPath = strings.Trim(c.RootPath, "/"); c.RootPath != "" {
+			if c.SharedWithMe {
+				return fmt.Errorf("RootPath cannot be used with SharedWithMe")
+			}
+			c.RootPath = "/" + c.RootPath
+		}
+	case "local":
+		if c.LocalRoot == "" {
+			return fmt.Errorf("Please specify a local root directory")
+		}
+	default:
+		return fmt.Errorf("Unknown backend: %s", c.Backend)
+	}
+
+	if c.Ignore != "" {
+		if c.ignoreRegex, err = regexp.Compile(c.Ignore); err != nil {
+			return err
+		}
+	}
+	if c.Prefetch != "" {
+		if c.prefetchRegex, err = regexp.Compile(c.Prefetch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHandlerPath tells if path can have its own handler, which must not take the place of Main or WebDAV
+func checkHandlerPath(name, path string) error {
+	if path == "" || path == "/" {
+		return fmt.Errorf("%s needs a path other than /", name)
+	}
+	if dav := "/" + strings.Trim(conf.WebDAVPrefix, "/"); dav != "/" && (path == dav || strings.HasPrefix(path, dav+"/")) {
+		return fmt.Errorf("%s cannot be under the WebDAV prefix %s", name, dav)
+	}
+	return nil
+}
+
+func newMount(prefix string, c *config) *mount {
+	m := &mount{Prefix: prefix, conf: c}
+	if c.Backend == "local" {
+		m.backend = newLocalBackend(c.LocalRoot)
+		log.Println("Local backend:", "/"+prefix, c.LocalRoot)
+	} else {
+		m.one = newOneManager(c)
+		m.backend = m.one
+	}
+	return m
+}
+
+// initMounts creates the drives of conf, which must have been checked
+func initMounts() error {
+	if len(conf.Drives) == 0 {
+		mounts = []*mount{newMount("", conf)}
+		return nil
+	}
+
+	seen := map[string]bool{}
+	for i, d := range conf.Drives {
+		d.Mount = strings.Trim(d.Mount, "/")
+		if d.Mount == "" || strings.Contains(d.Mount, "/") {
+			return fmt.Errorf("drive #%d: the mount must be a single folder name", i+1)
+		}
+		if seen[d.Mount] {
+			return fmt.Errorf("drive #%d: %s is mounted twice", i+1, d.Mount)
+		}
+		seen[d.Mount] = true
+
+		d.inherit(conf)
+		if err := d.check(); err != nil {
+			return fmt.Errorf("drive %s: %v", d.Mount, err)
+		}
+	}
+
+	for _, d := range conf.Drives {
+		mounts = append(mounts, newMount(d.Mount, d))
+	}
+	return nil
+}
+
+// mountOf returns the drive serving path and the path inside it, the drive is nil for the combined root
+func mountOf(path string) (*mount, string) {
+	if len(mounts) == 1 && mounts[0].Prefix == "" {
+		return mounts[0], path
+	}
+
+	name := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	for _, m := range mounts {
+		if m.Prefix == name {
+			return m, path[len(name)+1:]
+		}
+	}
+	return nil, path
+}
+
+// listPath lists path across all drives, an unknown mount is reported as an error
+func listPath(ctx context.Context, path string) (*mount, *driveItems) {
+	m, rel := mountOf(path)
+	if m != nil {
+		if rel == "" {
+			rel = "/"
+		}
+		return m, m.backend.List(ctx, rel)
+	}
+
+	x := &driveItems{}
+	if strings.Trim(path, "/") != "" {
+		x.Error.Message = "No such drive: " + strings.Trim(path, "/")
+		return nil, x
+	}
+
+	// concurrent visitors of the root wait for one round of Stat calls
+	rootCache.Lock()
+	defer rootCache.Unlock()
+	ttl := int64(conf.CacheTTL)
+	if ttl < 10 {
+		ttl = 10
+	}
+	if c := rootCache.x; c != nil && time.Now().Unix()-c.ts < ttl {
+		return nil, c
+	}
+
+	failed := false
+	for _, m := range mounts {
+		item, err := m.backend.Stat(ctx, "/")
+		if err != nil {
+			failed = true
+			item = &driveItem{Folder: &_folder{}}
+			item.LastModifiedDateTime = time.Unix(0, 0).UTC().Format(time.RFC3339)
+		}
+		if item.Folder == nil {
+			item.Folder = &_folder{}
+		}
+		item.Name = m.Prefix
+		x.Values = append(x.Values, item)
+	}
+	x.ts = time.Now().Unix()
+	if !failed {
+		rootCache.x = x
+	}
+	return nil, x
+}
+
+// rootCache holds the listing of the drives at the root, which is cached like any other listing
+var rootCache struct {
+	sync.Mutex
+	x *driveItems
+}
+
+// search answers q from the index of m when it has been built, and from the backend otherwise
+func (m *mount) search(ctx context.Context, q string) *driveItems {
+	if m.index != nil && m.index.ready() {
+		return m.index.Search(q)
+	}
+	if strings.HasPrefix(q, recentPrefix) {
+		x := &driveItems{}
+		x.Error.Message = "Recently changed files can only be listed from the search index"
+		return x
+	}
+	return m.backend.Search(ctx, "/", q)
+}
+
+// start begins the background work of m: the crawler of the search index and the delta poller
+func (m *mount) start() {
+	if m.conf.IndexFile != "" {
+		m.index = newSearchIndex(m)
+	}
+	if m.one != nil {
+		m.one.startDelta()
+	}
+}
+
+// Close stops the background work of m
+func (m *mount) Close() {
+	if m.index != nil {
+		m.index.Close()
+	}
+	if m.one != nil {
+		m.one.Close()
+	}
+}
+
+// searchPath searches the drive mounted at path, or every drive at the combined root. The results
+// are named by their path from where the search started and link into this server, items under
+// an ignored folder are only returned to admins.
+func searchPath(ctx context.Context, path, q string, admin bool) (*mount, *driveItems) {
+	m, _ := mountOf(path)
+	targets := []*mount{m}
+	if m == nil {
+		if strings.Trim(path, "/") != "" {
+			x := &driveItems{}
+			x.Error.Message = "No such drive: " + strings.Trim(path, "/")
+			return nil, x
+		}
+		targets = mounts
+	}
+
+	x := &driveItems{}
+	var failed []string
+	searched := 0
+	for _, t := range targets {
+		prefix := ""
+		if m == nil {
+			prefix = t.Prefix + "/"
+			if m.hidden(t.Prefix) && !admin {
+				continue
+			}
+		}
+
+		r := t.search(ctx, q)
+		if r.Error.Message != "" {
+			failed = append(failed, strings.TrimSuffix(prefix, "/")+" "+r.Error.Message)
+			continue
+		}
+		searched++
+
+		base := "/"
+		if t.Prefix != "" {
+			base += t.Prefix + "/"
+		}
+		for _, v := range r.Values {
+			dir := strings.Trim(v.ParentReference.Path, "/")
+			if dir != "" {
+				dir += "/"
+			}
+
+			hidden := m == nil && m.hidden(t.Prefix)
+			for _, name := range strings.Split(dir+v.Name, "/") {
+				hidden = hidden || name != "" && t.hidden(name)
+			}
+			if hidden && !admin {
+				continue
+			}
+
+			item := *v
+			item.isHidden = hidden
+			item.Name = prefix + dir + v.Name
+			if item.href = itemHref(t, base+dir, v); item.href == "" {
+				// items from the index have no download URL, ?file= fetches a fresh one
+				item.href = "?file=" + url.QueryEscape(v.Name)
+			}
+			if strings.HasPrefix(item.href, "?") {
+				item.href = base + dir + item.href
+			}
+			x.Values = append(x.Values, &item)
+		}
+	}
+
+	if len(failed) > 0 {
+		msg := strings.TrimSpace(strings.Join(failed, "; "))
+		if searched == 0 {
+			x.Error.Message = msg
+		} else {
+			x.warning = "Some drives could not be searched: " + msg
+		}
+	}
+	x.ts = time.Now().Unix()
+	return m, x
+}
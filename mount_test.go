@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDrives(t *testing.T) {
+	e := newTestEnv(t, func(c *config) {
+		c.Ignore = `^work$`
+		c.Drives = []*config{
+			{Mount: "personal", Ignore: `^hello\.txt$`},
+			{Mount: "work", RootPath: "/docs"},
+		}
+	})
+	defer e.Close()
+
+	// each drive is signed in on its own
+	for _, m := range mounts {
+		resp, err := e.client(true).Get(e.srv.URL + "/" + m.Prefix + "/?auth")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if m.one.tokens.Tokens().Refresh == "" {
+			t.Fatalf("%s is not signed in: %s", m.Prefix, resp.Status)
+		}
+	}
+
+	list := func(c *http.Client, path string) (int, string) {
+		resp, body := e.get(t, c, path+"?format=json", nil)
+		var l struct {
+			listing
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(body), &l); err != nil {
+			t.Fatalf("%s: %q", path, body)
+		}
+		if l.Error != "" {
+			return resp.StatusCode, l.Error
+		}
+		var res []string
+		for _, v := range l.Items {
+			res = append(res, v.Name)
+		}
+		return resp.StatusCode, strings.Join(res, ",")
+	}
+
+	visitor, admin := e.client(false), e.client(true)
+	for _, c := range []struct {
+		c          *http.Client
+		path, want string
+	}{
+		// the top Ignore hides drives at the combined root, each drive has its own
+		{visitor, "/", "personal"},
+		{admin, "/", "personal,work"},
+		{visitor, "/personal/", "builds,docs,readme.md"},
+		{visitor, "/personal/docs/", ""},
+		{admin, "/personal/docs/", "hello.txt"},
+		{visitor, "/work/", "hello.txt"},
+	} {
+		if _, got := list(c.c, c.path); got != c.want {
+			t.Errorf("%s lists %q, want %q", c.path, got, c.want)
+		}
+	}
+	if status, got := list(visitor, "/nope/"); status != http.StatusInternalServerError || got != "No such drive: nope" {
+		t.Errorf("got %d %q for an unknown drive", status, got)
+	}
+	if _, body := e.get(t, visitor, "/work/?file=hello.txt", nil); body != "hello world\n" && !strings.Contains(body, "/download/") {
+		t.Errorf("got %q for a file of the work drive", body)
+	}
+
+	// the combined root is cached like any other listing
+	e.f.Fail("", http.StatusInternalServerError)
+	e.f.Fail("/docs", http.StatusInternalServerError)
+	if _, got := list(admin, "/"); got != "personal,work" {
+		t.Errorf("the root lists %q while the drives fail", got)
+	}
+}
+
+func TestRedirURLCheck(t *testing.T) {
+	for _, redir := range []string{"https://example.com", "https://example.com/"} {
+		conf = &config{ClientID: "id", ClientSecret: "secret", RedirURL: redir}
+		if err := conf.check(); err == nil {
+			t.Errorf("RedirURL %s has passed the check", redir)
+		}
+	}
+
+	// app-only drives are never signed in and need no callback
+	conf = &config{ClientID: "id", ClientSecret: "secret", AuthMode: "app", Tenant: "contoso", UserID: "u"}
+	if err := conf.check(); err != nil {
+		t.Fatal(err)
+	}
+}
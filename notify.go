@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// subscriptionTTL is how long a subscription asks to live, drive items allow up to about 29 days
+	subscriptionTTL   = 48 * time.Hour
+	subscriptionRenew = 12 * time.Hour
+	subscriptionRetry = 5 * time.Minute
+	// deltaFallback is how often the drive is still polled when only notifications are enabled, they may be lost
+	deltaFallback = time.Hour
+)
+
+type subscription struct {
+	ID                 string     `json:"id,omitempty"`
+	ChangeType         string     `json:"changeType,omitempty"`
+	NotificationURL    string     `json:"notificationUrl,omitempty"`
+	Resource           string     `json:"resource,omitempty"`
+	ExpirationDateTime string     `json:"expirationDateTime"`
+	ClientState        string     `json:"clientState,omitempty"`
+	Error              graphError `json:"error"`
+}
+
+// subscriber keeps a Graph subscription on the drive root alive, so Graph calls NotifyURL
+// whenever something in the drive changes
+type subscriber struct {
+	o     *oneManager
+	state string
+
+	mu      sync.Mutex
+	id      string
+	expires time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSubscriber(o *oneManager) *subscriber {
+	s := &subscriber{
+		o:     o,
+		state: randomString(24),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *subscriber) run() {
+	defer close(s.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.stop
+		cancel()
+	}()
+
+	for {
+		wait := subscriptionRetry
+		if err := s.renew(ctx); err == errNotSignedIn {
+			// subscribe soon after the admin signs in
+			wait = 10 * time.Second
+		} else if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Subscription:", err)
+			}
+		} else {
+			s.mu.Lock()
+			wait = time.Until(s.expires) - subscriptionRenew
+			s.mu.Unlock()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// renew extends the subscription, or creates one if there is none or Graph has forgotten it
+func (s *subscriber) renew(ctx context.Context) error {
+	s.mu.Lock()
+	id := s.id
+	s.mu.Unlock()
+
+	expires := time.Now().Add(subscriptionTTL).UTC()
+	sub := &subscription{ExpirationDateTime: expires.Format(time.RFC3339)}
+	if id != "" {
+		status, err := s.o.sendJSON(ctx, "PATCH", "/subscriptions/"+id, sub, sub, &sub.Error)
+		if err == nil {
+			s.set(id, expires)
+			return nil
+		}
+		if status != http.StatusNotFound {
+			return err
+		}
+		log.Println("Subscription", id, "is gone, creating a new one")
+	}
+
+	sub = &subscription{
+		ChangeType:         "updated",
+		NotificationURL:    s.o.conf.NotifyURL,
+		Resource:           s.o.driveRoot() + "/root",
+		ExpirationDateTime: expires.Format(time.RFC3339),
+		ClientState:        s.state,
+	}
+	// Graph validates NotifyURL before it answers, so the server must already be reachable
+	if _, err := s.o.sendJSON(ctx, "POST", "/subscriptions", sub, sub, &sub.Error); err != nil {
+		return err
+	}
+	s.set(sub.ID, expires)
+	log.Println("Subscription", sub.ID, "created for", sub.Resource)
+	return nil
+}
+
+func (s *subscriber) set(id string, expires time.Time) {
+	s.mu.Lock()
+	s.id, s.expires = id, expires
+	s.mu.Unlock()
+}
+
+// owns tells if a notification carries the client state of this subscriber
+func (s *subscriber) owns(state string) bool {
+	return subtle.ConstantTimeCompare([]byte(state), []byte(s.state)) == 1
+}
+
+// Close stops renewing and deletes the subscription, so Graph stops calling a server that is gone
+func (s *subscriber) Close() {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	id := s.id
+	s.mu.Unlock()
+	if id != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		v := &struct {
+			Error graphError `json:"error"`
+		}{}
+		if _, err := s.o.sendJSON(ctx, "DELETE", "/subscriptions/"+id, nil, v, &v.Error); err != nil {
+			log.Println("Subscription", id, "not deleted:", err)
+		}
+	}
+}
+
+// sendJSON sends body to Graph with method and decodes the answer into v
+func (o *oneManager) sendJSON(ctx context.Context, method, endpoint string, body, v interface{}, e *graphError) (int, error) {
+	access, err := o.tokens.Token(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := o.breaker.allow(); err != nil {
+		return 0, err
+	}
+
+	req := o.MakeRequest(ctx, endpoint, access)
+	req.Method = method
+	if body != nil {
+		buf, _ := json.Marshal(body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		req.ContentLength = int64(len(buf))
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// creating a subscription waits for Graph to validate the notification URL
+	client := *o.httpClient
+	client.Timeout = 30 * time.Second
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+	buf, _ := ioutil.ReadAll(resp.Body)
+	if len(buf) > 0 {
+		json.Unmarshal(buf, v)
+	}
+	if e.Message != "" {
+		return resp.StatusCode, fmt.Errorf("%s: %s", e.Code, e.Message)
+	}
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("Graph answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Notify receives the change notifications of Graph and wakes up the delta poller of the drive
+func Notify(w http.ResponseWriter, r *http.Request) {
+	// Graph checks the URL by sending a token it expects back as plain text
+	if token := r.URL.Query().Get("validationToken"); token != "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write([]byte(token))
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	v := &struct {
+		Value []struct {
+			SubscriptionID string `json:"subscriptionId"`
+			ClientState    string `json:"clientState"`
+		} `json:"value"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, n := range v.Value {
+		for _, m := range mounts {
+			if m.one != nil && m.one.notify != nil && m.one.notify.owns(n.ClientState) {
+				m.one.delta.poke()
+			}
+		}
+	}
+	// Graph wants an answer within a few seconds, the sync happens in the background
+	w.WriteHeader(http.StatusAccepted)
+}
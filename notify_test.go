@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.NotifyURL = strings.TrimSuffix(c.RedirURL, "/callback") + "/notify" })
+	defer e.Close()
+
+	// Graph checks the URL before it creates a subscription
+	resp, body := e.get(t, e.client(false), "/notify?validationToken=a%2Bb%3Cc", nil)
+	if body != "a+b<c" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("got %q as %s for the validation token", body, resp.Header.Get("Content-Type"))
+	}
+	if resp, _ := e.get(t, e.client(false), "/notify", nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("got %s for a GET without a token, want 405", resp.Status)
+	}
+
+	e.signIn(t)
+	e.m.start()
+	subscribed := func() int {
+		e.f.mu.Lock()
+		defer e.f.mu.Unlock()
+		return len(e.f.subs)
+	}
+	waitFor(t, "the subscription", func() bool {
+		buf, _ := ioutil.ReadFile(conf.TokenFile + ".delta")
+		return subscribed() == 1 && len(buf) > 0
+	})
+
+	names := func() string {
+		x := e.m.backend.List(context.Background(), "/docs/")
+		var res []string
+		for _, v := range x.Values {
+			res = append(res, v.Name)
+		}
+		return strings.Join(res, ",")
+	}
+	if got := names(); got != "hello.txt" {
+		t.Fatalf("/docs lists %s", got)
+	}
+
+	// the fake notifies the subscription, which makes the delta poller drop the cached /docs
+	e.f.AddFile("/docs/new.txt", "new")
+	waitFor(t, "the notification", func() bool { return names() == "hello.txt,new.txt" })
+
+	e.m.Close()
+	mounts = nil
+	if subscribed() != 0 {
+		t.Fatal("the subscription has not been deleted on close")
+	}
+}
+
+// waitFor polls cond for up to 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(20 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%s did not happen in time", what)
+		}
+	}
+}
+
+func TestNotifyURLCheck(t *testing.T) {
+	for _, c := range []struct {
+		notify, webdav string
+	}{
+		{"https://example.com", ""},
+		{"https://example.com/", ""},
+		{"https://example.com/callback", ""},
+		{"https://example.com/dav/notify", "/dav/"},
+		{"https://example.com/dav", "dav"},
+	} {
+		conf = &config{
+			ClientID:     "id",
+			ClientSecret: "secret",
+			RedirURL:     "https://example.com/callback",
+			NotifyURL:    c.notify,
+			WebDAVPrefix: c.webdav,
+		}
+		if err := conf.check(); err == nil {
+			t.Errorf("NotifyURL %s with the WebDAV prefix %q has passed the check", c.notify, c.webdav)
+		}
+	}
+
+	conf.NotifyURL, conf.WebDAVPrefix = "https://example.com/notify", "/dav"
+	if err := conf.check(); err != nil {
+		t.Fatal(err)
+	}
+}
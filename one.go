@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -11,45 +12,31 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/coyove/common/lru"
-)
-
-const (
-	refreshLimit = 3550
-)
-
-type _state int
-
-const (
-	stateOK = iota + 1
-	stateNotYet
-	stateTimeout
-	stateRefreshFailed
 )
 
-type _stream struct {
-	ts       int64
-	callback chan _state
-}
-
 type oneManager struct {
-	client struct {
+	// searchGen is first to stay 64-bit aligned for atomic
+	searchGen int64
+	client    struct {
 		id, secret string
 		redir      string
 	}
-	access, refresh string
-	exit            chan bool
-	stream          chan _stream
-	lastRefreshed   int64
-	httpClient      *http.Client
-	dirTemplate     *template.Template
-	cache           *lru.Cache
-	cacheTTL        int64
-	prefetch        *lru.Cache
-	icons           map[string][]byte
-	conf            *config
+	tokens      *tokenSource
+	breaker     breaker
+	httpClient  *http.Client
+	fileClient  *http.Client
+	dirTemplate *template.Template
+	cache       *dirCache
+	cacheTTL    int64
+	conf        *config
+	folders     folderIndex
+	listMu      sync.Mutex
+	lists       map[string]*listCall
+	delta       *deltaPoller
+	notify      *subscriber
 }
 
 func newOneManager(conf *config) *oneManager {
@@ -62,6 +49,14 @@ func newOneManager(conf *config) *oneManager {
 		Timeout: time.Second * 2,
 	}
 
+	// downloads may take any time to read, only waiting for the headers is bounded,
+	// the body is bounded by the request's context
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Second * 10
+	o.fileClient = &http.Client{
+		Transport: transport,
+	}
+
 	if conf.CacheSize < 32 {
 		conf.CacheSize = 32
 	}
@@ -69,240 +64,544 @@ func newOneManager(conf *config) *oneManager {
 		conf.CacheTTL = 10
 	}
 
-	o.cache = lru.NewCache(int64(conf.CacheSize))
+	o.cache = newDirCache(conf.CacheSize, conf.CacheDir)
 	o.cacheTTL = int64(conf.CacheTTL)
-	o.prefetch = lru.NewCache(int64(conf.PrefetchSize) * 1024 * 1024)
-	o.prefetch.OnEvicted = func(k lru.Key, v interface{}) {
-		go func() {
-			time.Sleep(time.Second)
-			os.Remove(k.(string))
-		}()
+	for _, v := range o.cache.load() {
+		o.folders.note(v.Path, v.Values)
 	}
-	o.icons = DefaultIcons
 
-	buf, _ := ioutil.ReadFile(o.client.id + ".token")
-	parts := strings.Split(string(buf), "\n")
-	if len(parts) == 3 {
-		o.lastRefreshed, _ = strconv.ParseInt(parts[0], 10, 64)
-		o.access = parts[1]
-		o.refresh = parts[2]
-		o.Restart()
-		log.Println("Preloaded from ", o.client.id, ".token:", time.Unix(o.lastRefreshed, 0))
+	if conf.TokenFile == "" {
+		conf.TokenFile = conf.ClientID + ".token"
 	}
-	return o
-}
-
-func (o *oneManager) saveTokens() {
-	ioutil.WriteFile(o.client.id+".token", []byte(
-		strconv.Itoa(int(time.Now().Unix()))+"\n"+
-			o.access+"\n"+
-			o.refresh,
-	), 0755)
-}
-
-func (o *oneManager) WaitState() _state {
-	if o.lastRefreshed == 0 {
-		return stateNotYet
-	}
-
-	now := time.Now().Unix()
-	if now-o.lastRefreshed < refreshLimit-10 {
-		return stateOK
+	key := os.Getenv("GONE_TOKEN_KEY")
+	if key == "" {
+		key = conf.TokenKey
 	}
-
-	cb := make(chan _state, 1)
-	o.stream <- _stream{
-		ts:       now,
-		callback: cb,
+	if conf.appOnly() {
+		o.tokens = newTokenSource(newFileTokenStore(conf.TokenFile, key), o.ClientCredentials, true)
+	} else {
+		o.tokens = newTokenSource(newFileTokenStore(conf.TokenFile, key), o.RefreshToken, false)
 	}
 
-	select {
-	case resp := <-cb:
-		return resp
-	case <-time.After(time.Second):
-		return stateTimeout
+	// a legacy or plain file is saved again in the current format, encrypted once a key is configured
+	if err := o.tokens.Load(); err == nil {
+		log.Println("Preloaded from", conf.TokenFile+":", time.Unix(o.tokens.Tokens().Refreshed, 0))
+	} else if !os.IsNotExist(err) {
+		log.Println("Load tokens:", err)
 	}
+	o.checkScopes()
+	return o
 }
 
-func (o *oneManager) Restart() {
-	if o.exit != nil {
-		o.exit <- true
+// Close stops refreshing the tokens in the background
+func (o *oneManager) Close() {
+	if o.notify != nil {
+		o.notify.Close()
 	}
-	o.exit = make(chan bool, 1)
-	o.stream = make(chan _stream, 1024)
-
-	go func() {
-		exit2 := make(chan bool, 1)
-		go func() {
-			for {
-				select {
-				case <-exit2:
-					return
-				default:
-				}
-
-				select {
-				case <-exit2:
-					return
-				case o.stream <- _stream{
-					ts:       time.Now().Unix(),
-					callback: make(chan _state, 1),
-				}:
-					// Ping every second
-				}
-				time.Sleep(time.Second)
-			}
-		}()
-
-		for {
-			// exit signal always comes first
-			select {
-			case <-o.exit:
-				return
-			default:
-			}
-
-			select {
-			case s := <-o.stream:
-				if s.ts-o.lastRefreshed < refreshLimit {
-					s.callback <- stateOK
-					continue
-				}
-
-				start := time.Now()
-				err := o.RefreshToken()
-				log.Println("Refresh token in", time.Now().Sub(start).Seconds(), "s")
-
-				if err != nil {
-					log.Println("Refresh token:", err)
-					s.callback <- stateRefreshFailed
-					continue
-				}
-
-				o.lastRefreshed = time.Now().Unix()
-				log.Println("New token is OK at", time.Now())
-				s.callback <- stateOK
-			case <-o.exit:
-				log.Println("Old dying")
-				exit2 <- true
-				return
-			}
-		}
-	}()
+	if o.delta != nil {
+		o.delta.Close()
+	}
+	o.tokens.Close()
 }
 
-func (o *oneManager) MakeForm() url.Values {
+// MakeForm starts a form for the token service, a public client proves nothing but its ID
+func (o *oneManager) MakeForm(public bool) (url.Values, error) {
 	form := url.Values{}
 	form.Add("client_id", o.client.id)
 	form.Add("redirect_uri", o.client.redir)
-	form.Add("client_secret", o.client.secret)
-	return form
+	if public {
+		return form, nil
+	}
+	return form, o.authenticate(form)
+}
+
+// AuthorizeURL returns where the admin signs in to the Microsoft account, state is passed back to the callback
+// and challenge is the S256 PKCE challenge of the verifier the callback will present
+func (o *oneManager) AuthorizeURL(state, challenge string) string {
+	q := url.Values{}
+	q.Set("client_id", o.client.id)
+	q.Set("scope", o.conf.graphScopes(o.conf.scopes()))
+	q.Set("response_type", "code")
+	q.Set("redirect_uri", o.client.redir)
+	q.Set("state", state)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+	return o.conf.LoginURL + "/authorize?" + q.Encode()
 }
 
-func (o *oneManager) MakeRequest(endpoint string) *http.Request {
-	req, _ := http.NewRequest("GET", "https://graph.microsoft.com/v1.0"+endpoint, nil)
-	req.Header.Add("Authorization", "bearer "+o.access)
-	return req
+func (o *oneManager) MakeRequest(ctx context.Context, endpoint, access string) *http.Request {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = o.conf.GraphURL + endpoint
+	}
+	req, _ := http.NewRequest("GET", endpoint, nil)
+	req.Header.Add("Authorization", "bearer "+access)
+	return req.WithContext(ctx)
 }
 
-func (o *oneManager) GetTokenCallback(w http.ResponseWriter, r *http.Request) {
+// GetTokenCallback redeems the authorization code, AuthCallback has checked the state
+func (o *oneManager) GetTokenCallback(w http.ResponseWriter, r *http.Request, verifier string) {
 	code := r.FormValue("code")
 	if code == "" {
-		w.WriteHeader(http.StatusBadRequest)
+		writeAuthError(w, "no authorization code")
 		return
 	}
 
-	form := o.MakeForm()
+	form, err := o.MakeForm(false)
+	if err != nil {
+		writeAuthError(w, err.Error())
+		return
+	}
 	form.Add("code", code)
+	form.Add("code_verifier", verifier)
 	form.Add("grant_type", "authorization_code")
-	req, _ := http.NewRequest("POST", "https://login.microsoftonline.com/common/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+	req, _ := http.NewRequest("POST", o.conf.LoginURL+"/token", strings.NewReader(form.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := http.DefaultClient.Do(req.WithContext(r.Context()))
 	if err != nil {
-		w.Write([]byte(err.Error()))
+		writeAuthError(w, err.Error())
 		return
 	}
 
 	defer resp.Body.Close()
 	buf, _ := ioutil.ReadAll(resp.Body)
 
-	o.access, o.refresh = parseToken(buf)
-	if o.access == "" || o.refresh == "" {
+	t := parseToken(buf)
+	if t.Access == "" || t.Refresh == "" {
 		log.Println(resp.Status)
 		log.Println(string(buf))
+		writeAuthError(w, "the token service answered "+resp.Status)
 		return
 	}
 
-	log.Println("Init new token:", len(o.access), len(o.refresh))
-	o.saveTokens()
-	o.Restart()
+	o.tokens.Set(t)
+	log.Println("Init new token:", len(t.Access), len(t.Refresh))
+	o.checkScopes()
 
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	http.Redirect(w, r, strings.TrimSuffix("/"+o.conf.Mount, "/")+"/", http.StatusTemporaryRedirect)
 }
 
-func (o *oneManager) RefreshToken() error {
-	form := o.MakeForm()
-	form.Add("refresh_token", o.refresh)
+// RefreshToken exchanges the refresh token of old for new tokens. Tokens of the device code login
+// belong to the public client, the token service rejects a secret or certificate when refreshing them.
+func (o *oneManager) RefreshToken(ctx context.Context, old tokens) (*tokens, error) {
+	form, err := o.MakeForm(old.Public)
+	if err != nil {
+		return nil, err
+	}
+	form.Add("refresh_token", old.Refresh)
 	form.Add("grant_type", "refresh_token")
-	req, _ := http.NewRequest("POST", "https://login.microsoftonline.com/common/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+	req, _ := http.NewRequest("POST", o.conf.LoginURL+"/token", strings.NewReader(form.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 	buf, _ := ioutil.ReadAll(resp.Body)
-	o.access, o.refresh = parseToken(buf)
-	if o.access == "" || o.refresh == "" {
-		return fmt.Errorf("failed to refresh token: %s", resp.Status)
+	t := parseToken(buf)
+	if t.Access == "" || t.Refresh == "" {
+		return nil, fmt.Errorf("failed to refresh token: %s", resp.Status)
 	}
+	t.Public = old.Public
+	return t, nil
+}
 
-	o.saveTokens()
-	return nil
+// drivePath returns the Graph endpoint of path below the item base, with an optional action like "children"
+func drivePath(base, path, action string) string {
+	path = strings.TrimSuffix(path, "/")
+	if path == "" {
+		if action == "" {
+			return base
+		}
+		return base + "/" + action
+	}
+	if action == "" {
+		return base + ":" + path
+	}
+	return base + ":" + path + ":/" + action
+}
+
+// driveRoot returns the Graph endpoint of the configured drive
+func (o *oneManager) driveRoot() string {
+	switch {
+	case o.conf.DriveID != "":
+		return "/drives/" + o.conf.DriveID
+	case o.conf.SiteID != "":
+		return "/sites/" + o.conf.SiteID + "/drive"
+	case o.conf.UserID != "":
+		return "/users/" + o.conf.UserID + "/drive"
+	}
+	return "/me/drive"
+}
+
+// itemPath returns the Graph endpoint of path inside the index root. Under SharedWithMe
+// the first folder of path is one of the shared items, which may live in another drive.
+func (o *oneManager) itemPath(ctx context.Context, path, action string) (string, error) {
+	if !o.conf.SharedWithMe {
+		return drivePath(o.driveRoot()+"/root", o.conf.RootPath+strings.TrimSuffix(path, "/"), action), nil
+	}
+
+	name := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	x := o.List(ctx, "/")
+	if x.Error.Message != "" {
+		return "", fmt.Errorf("%s", x.Error.Message)
+	}
+	for _, v := range x.Values {
+		if v.Name == name {
+			return drivePath("/drives/"+v.ParentReference.DriveID+"/items/"+v.ID, path[len(name)+1:], action), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not shared with this account", name)
+}
+
+// sharedRoot tells if path is the list of items shared with the account
+func (o *oneManager) sharedRoot(path string) bool {
+	return o.conf.SharedWithMe && strings.Trim(path, "/") == ""
+}
+
+// sharedItem turns an entry of sharedWithMe into the item it points to
+func sharedItem(v *driveItem) *driveItem {
+	r := v.RemoteItem
+	if r == nil {
+		return v
+	}
+	r.Name = v.Name
+	if r.LastModifiedDateTime == "" {
+		r.LastModifiedDateTime = v.LastModifiedDateTime
+	}
+	if r.CreatedDateTime == "" {
+		r.CreatedDateTime = v.CreatedDateTime
+	}
+	return r
+}
+
+// downloadURLTTL caps the age of a listing served from the cache, as the download URLs in it expire
+const downloadURLTTL = 45 * time.Minute
+
+// fresh tells if the cached x can be served, neither CacheTTL nor its download URLs have expired
+func (o *oneManager) fresh(x *driveItems) bool {
+	age := time.Now().Unix() - x.ts
+	return age < o.cacheTTL && age < int64(downloadURLTTL/time.Second)
 }
 
-func (o *oneManager) List(path string) (x *driveItems) {
+// listTimeout bounds a listing shared by concurrent visitors, it may take many pages
+const listTimeout = 2 * time.Minute
+
+func (o *oneManager) List(ctx context.Context, path string) (x *driveItems) {
+	var stale *driveItems
 	if i, ok := o.cache.Get(path); ok {
 		x = i.(*driveItems)
-		if time.Now().Unix()-x.ts < o.cacheTTL {
+		if o.fresh(x) {
 			return
 		}
+		stale = x
 	}
 
-	x = &driveItems{}
+	// an expired listing is still better than an error page while Graph is down or throttling
+	defer func() {
+		if x.Error.Message != "" && stale != nil && ctx.Err() == nil {
+			msg := x.Error.Message
+			x = &driveItems{ts: stale.ts, Values: stale.Values}
+			x.warning = fmt.Sprintf("This listing is from %s ago, OneDrive could not be reached: %s",
+				time.Since(time.Unix(stale.ts, 0)).Truncate(time.Second), msg)
+		}
+	}()
 
-	state := o.WaitState()
-	switch state {
-	case stateNotYet:
-		x.Error.Message = "Server is not available yet"
-		return
-	case stateTimeout:
-	case stateRefreshFailed:
-		x.Error.Message = "Please try again later"
-		return
+	l, leader := o.startListing(path)
+	if leader {
+		// the listing is not bound to the context of the first caller, so the others still get it if
+		// that one goes away, and a failure counts only once against the breaker
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+			defer cancel()
+			l.x = o.fetchList(ctx, path)
+			if l.x.Error.Message == "" {
+				if !o.sharedRoot(path) {
+					o.folders.note(path, l.x.Values)
+				}
+				o.cache.Add(path, l.x)
+			}
+			o.finishListing(path, l)
+		}()
 	}
 
-	xpath := ""
-	if path == "/" {
-		xpath = "/me/drive/root/children"
-	} else {
-		xpath = "/me/drive/root:" + path + ":/children"
+	select {
+	case <-l.done:
+		x = l.x
+	case <-ctx.Done():
+		x = &driveItems{}
+		x.Error.Message = ctx.Err().Error()
+	}
+	return
+}
+
+// listCall is a listing in flight, concurrent misses of the same path wait on it
+type listCall struct {
+	done chan struct{}
+	x    *driveItems
+}
+
+// startListing returns the listing in flight for path, leader is true if the caller should start it
+func (o *oneManager) startListing(path string) (l *listCall, leader bool) {
+	o.listMu.Lock()
+	defer o.listMu.Unlock()
+	if l = o.lists[path]; l != nil {
+		return l, false
+	}
+	if o.lists == nil {
+		o.lists = map[string]*listCall{}
 	}
+	l = &listCall{done: make(chan struct{})}
+	o.lists[path] = l
+	return l, true
+}
+
+func (o *oneManager) finishListing(path string, l *listCall) {
+	o.listMu.Lock()
+	delete(o.lists, path)
+	o.listMu.Unlock()
+	close(l.done)
+}
 
-	req := o.MakeRequest(xpath)
-	resp, err := o.httpClient.Do(req)
+// fetchList reads the listing of path from Graph, bypassing the cache
+func (o *oneManager) fetchList(ctx context.Context, path string) (x *driveItems) {
+	x = &driveItems{}
+	xpath, err := "/me/drive/sharedWithMe", error(nil)
+	if !o.sharedRoot(path) {
+		xpath, err = o.itemPath(ctx, path, "children")
+	}
 	if err != nil {
 		x.Error.Message = err.Error()
 		return
 	}
+	if o.conf.PageSize > 0 {
+		xpath += "?$top=" + strconv.Itoa(o.conf.PageSize)
+	}
+
+	if err := o.listAll(ctx, xpath, x); err != nil {
+		x.Error.Message = err.Error()
+		return
+	}
+	for i, v := range x.Values {
+		x.Values[i] = sharedItem(v)
+	}
+	x.ts = time.Now().Unix()
+	return
+}
+
+// listAll follows @odata.nextLink until all pages are read into x
+func (o *oneManager) listAll(ctx context.Context, xpath string, x *driveItems) error {
+	for page := 1; xpath != ""; page++ {
+		p := &driveItems{}
+		if err := o.getJSON(ctx, xpath, p, &p.Error); err != nil {
+			if page > 1 {
+				err = fmt.Errorf("partial listing, page %d failed after %d items: %v", page, len(x.Values), err)
+			}
+			return err
+		}
+		x.Values = append(x.Values, p.Values...)
+		xpath = p.NextLink
+	}
+	return nil
+}
+
+// getJSON reads endpoint into v, if Graph rejects the access token it is refreshed and the request retried once
+func (o *oneManager) getJSON(ctx context.Context, endpoint string, v interface{}, e *graphError) error {
+	access, err := o.tokens.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	status, err := o.doJSON(ctx, endpoint, access, v, e)
+	if err != nil && status == http.StatusUnauthorized && e.Code == "InvalidAuthenticationToken" {
+		log.Println("Access token rejected:", e.Message)
+		o.tokens.Invalidate(access)
+		if access, err = o.tokens.Token(ctx); err != nil {
+			return err
+		}
+		*e = graphError{}
+		_, err = o.doJSON(ctx, endpoint, access, v, e)
+	}
+	return err
+}
+
+func (o *oneManager) doJSON(ctx context.Context, endpoint, access string, v interface{}, e *graphError) (int, error) {
+	resp, err := o.get(ctx, endpoint, access)
+	if err != nil {
+		return 0, err
+	}
 
 	defer resp.Body.Close()
-	buf, _ := ioutil.ReadAll(resp.Body)
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil && resp.StatusCode/100 == 2 {
+		return resp.StatusCode, err
+	}
+	if e.Message != "" {
+		return resp.StatusCode, fmt.Errorf("%s: %s", e.Code, e.Message)
+	}
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("Graph answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (o *oneManager) Stat(ctx context.Context, path string) (*driveItem, error) {
+	if o.sharedRoot(path) {
+		x := o.List(ctx, path)
+		if x.Error.Message != "" {
+			return nil, fmt.Errorf("%s", x.Error.Message)
+		}
+		item := &driveItem{Folder: &_folder{ChildCount: len(x.Values)}}
+		item.LastModifiedDateTime = time.Unix(x.ts, 0).UTC().Format(time.RFC3339)
+		return item, nil
+	}
+
+	xpath, err := o.itemPath(ctx, path, "")
+	if err != nil {
+		return nil, err
+	}
+	return o.stat(ctx, xpath)
+}
+
+func (o *oneManager) stat(ctx context.Context, xpath string) (*driveItem, error) {
+	item := &struct {
+		driveItem
+		Error graphError `json:"error"`
+	}{}
+	if err := o.getJSON(ctx, xpath, item, &item.Error); err != nil {
+		return nil, err
+	}
+	return sharedItem(&item.driveItem), nil
+}
+
+// itemURL returns the Graph endpoint of item, which may belong to another drive under SharedWithMe
+func (o *oneManager) itemURL(item *driveItem) string {
+	if item.ParentReference.DriveID != "" {
+		return "/drives/" + item.ParentReference.DriveID + "/items/" + item.ID
+	}
+	return o.driveRoot() + "/items/" + item.ID
+}
+
+func (o *oneManager) Open(ctx context.Context, item *driveItem, h http.Header) (*http.Response, error) {
+	if item.DownloadURL == "" {
+		// items listed by sharedWithMe come without a download URL
+		v, err := o.stat(ctx, o.itemURL(item))
+		if err != nil {
+			return nil, err
+		}
+		item = v
+	}
+
+	req, err := http.NewRequest("GET", item.DownloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range h {
+		req.Header[k] = vs
+	}
+	return o.fileClient.Do(req)
+}
+
+func (o *oneManager) DownloadURL(item *driveItem) string {
+	if item.DownloadURL == "" {
+		return item.WebURL
+	}
+	return item.DownloadURL + "/" + item.Name
+}
+
+func (o *oneManager) Thumbnail(ctx context.Context, item *driveItem, size string) (string, error) {
+	thumb := &struct {
+		URL   string     `json:"url"`
+		Error graphError `json:"error"`
+	}{}
+	if err := o.getJSON(ctx, o.itemURL(item)+"/thumbnails/0/"+size, thumb, &thumb.Error); err != nil {
+		return "", err
+	}
+	return thumb.URL, nil
+}
+
+// searchKey keeps search results apart from the listings in the cache,
+// gen changes with every change reported by delta so older results are not used
+type searchKey struct {
+	gen     int64
+	path, q string
+}
+
+func (k searchKey) String() string {
+	return "search " + k.path + " " + k.q
+}
+
+// searchResolveLimit caps the items stat'ed one by one when Graph leaves out their parent path
+const searchResolveLimit = 50
+
+// Search finds q below path, the parent path of each result is made relative to the index root
+// and results outside of it are dropped
+func (o *oneManager) Search(ctx context.Context, path, q string) (x *driveItems) {
+	key := searchKey{atomic.LoadInt64(&o.searchGen), path, q}
+	if i, ok := o.cache.Get(key); ok {
+		if x = i.(*driveItems); o.fresh(x) {
+			return
+		}
+	}
+
+	x = &driveItems{}
+	if o.sharedRoot(path) {
+		x.Error.Message = "Search in the list of shared items is not supported"
+		return
+	}
+
+	xpath, err := o.itemPath(ctx, path, "search(q='"+url.PathEscape(strings.Replace(q, "'", "''", -1))+"')")
+	if err == nil {
+		err = o.listAll(ctx, xpath, x)
+	}
+	if err != nil {
+		x.Error.Message = err.Error()
+		return
+	}
 
-	json.Unmarshal(buf, x)
+	values, resolved := x.Values[:0], 0
+	for _, v := range x.Values {
+		v = sharedItem(v)
+		if v.ParentReference.Path == "" && resolved < searchResolveLimit {
+			// business drives return search hits without their path
+			resolved++
+			if s, err := o.stat(ctx, o.itemURL(v)); err == nil {
+				v = s
+			}
+		}
+		if dir, ok := o.relPath(v.ParentReference.Path); ok {
+			v.ParentReference.Path = dir
+			values = append(values, v)
+		}
+	}
+	x.Values = values
 
 	x.ts = time.Now().Unix()
-	o.cache.Add(path, x)
+	o.cache.Add(key, x)
 	return
 }
+
+// relPath turns the Graph path of a parent folder, like /drive/root:/a/b, into a path inside the index root
+func (o *oneManager) relPath(p string) (string, bool) {
+	i := strings.Index(p, "root:")
+	if i < 0 || o.conf.SharedWithMe {
+		return "", false
+	}
+	p = p[i+len("root:"):]
+	if u, err := url.PathUnescape(p); err == nil {
+		p = u
+	}
+
+	if root := o.conf.RootPath; root != "" {
+		if p != root && !strings.HasPrefix(p, root+"/") {
+			return "", false
+		}
+		p = p[len(root):]
+	}
+	return "/" + strings.Trim(p, "/"), true
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListPages(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.PageSize = 100 })
+	defer e.Close()
+	e.signIn(t)
+
+	x := e.m.backend.List(context.Background(), "/builds/")
+	if x.Error.Message != "" {
+		t.Fatal(x.Error.Message)
+	}
+	if len(x.Values) != 250 {
+		t.Fatalf("got %d items from 3 pages, want 250", len(x.Values))
+	}
+	for i, v := range x.Values {
+		if want := fmt.Sprintf("build-%03d.zip", i); v.Name != want {
+			t.Fatalf("item %d is %s, want %s", i, v.Name, want)
+		}
+	}
+}
+
+func TestListPartialPage(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.PageSize = 100 })
+	defer e.Close()
+	e.signIn(t)
+
+	e.f.FailFrom("/builds", 200, http.StatusInternalServerError)
+	x := e.m.backend.List(context.Background(), "/builds/")
+	if !strings.Contains(x.Error.Message, "partial listing, page 3 failed after 200 items") {
+		t.Fatalf("got error %q, want a partial listing", x.Error.Message)
+	}
+
+	// the partial listing must not have been cached
+	e.f.Fail("/builds", 0)
+	if x := e.m.backend.List(context.Background(), "/builds/"); x.Error.Message != "" || len(x.Values) != 250 {
+		t.Fatalf("got %d items and %q after the failure was cleared", len(x.Values), x.Error.Message)
+	}
+}
+
+func TestListStale(t *testing.T) {
+	e := newTestEnv(t, nil)
+	defer e.Close()
+	e.signIn(t)
+
+	if x := e.m.backend.List(context.Background(), "/docs/"); x.Error.Message != "" {
+		t.Fatal(x.Error.Message)
+	}
+	i, _ := e.m.one.cache.Get("/docs/")
+	i.(*driveItems).ts -= e.m.one.cacheTTL
+
+	e.f.Fail("/docs", http.StatusInternalServerError)
+	x := e.m.backend.List(context.Background(), "/docs/")
+	if x.Error.Message != "" || len(x.Values) != 1 || x.warning == "" {
+		t.Fatalf("got %d items, error %q and warning %q, want the expired listing", len(x.Values), x.Error.Message, x.warning)
+	}
+}
+
+func TestRefreshOnUnauthorized(t *testing.T) {
+	e := newTestEnv(t, nil)
+	defer e.Close()
+	e.signIn(t)
+
+	before := e.m.one.tokens.Tokens()
+	e.f.Expire()
+	x := e.m.backend.List(context.Background(), "/docs/")
+	if x.Error.Message != "" {
+		t.Fatal(x.Error.Message)
+	}
+	if after := e.m.one.tokens.Tokens(); after.Access == before.Access || after.Refresh == before.Refresh {
+		t.Fatalf("the rejected token %s was not refreshed", before.Access)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	e := newTestEnv(t, nil)
+	defer e.Close()
+	e.signIn(t)
+
+	x := e.m.backend.Search(context.Background(), "/", "BUILD-24")
+	if x.Error.Message != "" {
+		t.Fatal(x.Error.Message)
+	}
+	if len(x.Values) != 10 || x.Values[0].Name != "build-240.zip" {
+		t.Fatalf("got %d results, want build-240.zip to build-249.zip", len(x.Values))
+	}
+	if x := e.m.backend.Search(context.Background(), "/docs", "build"); len(x.Values) != 0 {
+		t.Fatalf("got %d results outside /docs", len(x.Values))
+	}
+}
+
+func TestSearchURLExpiry(t *testing.T) {
+	e := newTestEnv(t, func(c *config) { c.CacheTTL = 24 * 3600 })
+	defer e.Close()
+	e.signIn(t)
+	ctx := context.Background()
+
+	if x := e.m.backend.Search(ctx, "/", "hello"); len(x.Values) != 1 {
+		t.Fatalf("got %d results, want hello.txt", len(x.Values))
+	}
+	e.f.AddFile("/builds/hello.zip", "")
+	if x := e.m.backend.Search(ctx, "/", "hello"); len(x.Values) != 1 {
+		t.Fatalf("got %d results, want the cached result", len(x.Values))
+	}
+
+	// the download URLs in the results expire long before CacheTTL
+	i, _ := e.m.one.cache.Get(searchKey{atomic.LoadInt64(&e.m.one.searchGen), "/", "hello"})
+	i.(*driveItems).ts -= int64(downloadURLTTL / time.Second)
+	if x := e.m.backend.Search(ctx, "/", "hello"); len(x.Values) != 2 {
+		t.Fatalf("got %d results from results older than their download URLs", len(x.Values))
+	}
+}
+
+func TestDriveRoots(t *testing.T) {
+	for _, c := range []struct {
+		setup      func(c *config)
+		root, docs string
+	}{
+		{func(c *config) { c.DriveID = "b!drive" }, "builds,docs,readme.md", "/docs/"},
+		{func(c *config) { c.SiteID = "contoso.sharepoint.com,1,2" }, "builds,docs,readme.md", "/docs/"},
+		{func(c *config) { c.DriveID, c.RootPath = "b!drive", "/docs/" }, "hello.txt", "/"},
+		{func(c *config) { c.SharedWithMe = true }, "docs,readme.md", "/docs/"},
+	} {
+		e := newTestEnv(t, c.setup)
+		e.signIn(t)
+		ctx := context.Background()
+
+		names := func(path string) string {
+			x := e.m.backend.List(ctx, path)
+			if x.Error.Message != "" {
+				t.Fatal(x.Error.Message)
+			}
+			var res []string
+			for _, v := range x.Values {
+				res = append(res, v.Name)
+			}
+			return strings.Join(res, ",")
+		}
+		if got := names("/"); got != c.root {
+			t.Errorf("%+v: the root lists %s, want %s", conf, got, c.root)
+		}
+		if got := names(c.docs); got != "hello.txt" {
+			t.Errorf("%+v: %s lists %s, want hello.txt", conf, c.docs, got)
+		}
+
+		item, err := e.m.backend.Stat(ctx, c.docs+"hello.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := e.m.backend.Open(ctx, item, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(buf) != "hello world\n" {
+			t.Errorf("%+v: got %q from hello.txt", conf, buf)
+		}
+		e.Close()
+	}
+}
+
+func TestDeltaInvalidates(t *testing.T) {
+	e := newTestEnv(t, nil)
+	defer e.Close()
+	e.signIn(t)
+	ctx := context.Background()
+	o := e.m.one
+
+	names := func(path string) string {
+		x := o.List(ctx, path)
+		if x.Error.Message != "" {
+			t.Fatal(x.Error.Message)
+		}
+		var res []string
+		for _, v := range x.Values {
+			res = append(res, v.Name)
+		}
+		return strings.Join(res, ",")
+	}
+	send := func(method, path, body string) {
+		access, err := o.tokens.Token(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(method, e.f.URL+"/v1.0/me/drive/root:"+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "bearer "+access)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			t.Fatalf("%s %s: %s", method, path, resp.Status)
+		}
+	}
+
+	d := &deltaPoller{o: o, file: filepath.Join(e.dir, "test.delta")}
+	if err := d.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := names("/"); got != "builds,docs,readme.md" {
+		t.Fatalf("root lists %s", got)
+	}
+	if got := names("/docs/"); got != "hello.txt" {
+		t.Fatalf("/docs lists %s", got)
+	}
+
+	send("PUT", "/docs/new.txt:/content", "new")
+	if got := names("/docs/"); got != "hello.txt" {
+		t.Fatalf("/docs lists %s before the delta sync, want the cached listing", got)
+	}
+	if err := d.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := names("/docs/"); got != "hello.txt,new.txt" {
+		t.Fatalf("/docs lists %s after an upload", got)
+	}
+
+	send("DELETE", "/docs/new.txt", "")
+	if err := d.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := names("/docs/"); got != "hello.txt" {
+		t.Fatalf("/docs lists %s after a delete", got)
+	}
+
+	e.f.Remove("/docs")
+	if err := d.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := names("/"); got != "builds,readme.md" {
+		t.Fatalf("root lists %s after /docs was removed", got)
+	}
+	if _, ok := o.cache.Get("/docs/"); ok {
+		t.Fatal("the listing of the removed /docs is still cached")
+	}
+
+	// a delta link that is too old drops everything, the next sync starts over
+	d.link = e.f.URL + "/v1.0/me/drive/root/delta?token=999"
+	if err := d.sync(ctx); err == nil {
+		t.Fatal("an invalid delta link has been accepted")
+	}
+	if _, ok := o.cache.Get("/"); ok {
+		t.Fatal("the root listing is still cached after a resync")
+	}
+	if buf, _ := ioutil.ReadFile(d.file); d.link != "" || len(buf) != 0 {
+		t.Fatalf("kept the delta link %q after a resync", buf)
+	}
+	if err := d.sync(ctx); err != nil || d.link == "" {
+		t.Fatalf("got %v and no delta link after a resync", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// defaultScopes is enough for everything gone does, it never writes to the drive
+var defaultScopes = []string{"Files.Read.All", "offline_access"}
+
+// scopes returns the permissions to ask for when signing in
+func (c *config) scopes() []string {
+	if len(c.Scopes) > 0 {
+		return c.Scopes
+	}
+	if c.NotifyURL != "" {
+		return []string{"Files.ReadWrite.All", "offline_access"}
+	}
+	return defaultScopes
+}
+
+// requiredScopes returns the Graph permissions the enabled features need.
+// Features that write, like uploads or sharing links, add Files.ReadWrite.All here.
+func (c *config) requiredScopes() []string {
+	if c.NotifyURL != "" {
+		// Graph only allows subscriptions on drive items with write access
+		return []string{"Files.ReadWrite.All"}
+	}
+	return []string{"Files.Read.All"}
+}
+
+// graphScopes qualifies the Graph permissions in scopes with the Graph host,
+// which national clouds need as the short form always means the global Graph
+func (c *config) graphScopes(scopes []string) string {
+	qualified := hostURL(c.GraphHost) != hostURL(clouds["global"].graph)
+	res := make([]string, len(scopes))
+	for i, s := range scopes {
+		res[i] = s
+		switch strings.ToLower(s) {
+		case "offline_access", "openid", "profile", "email":
+		default:
+			if qualified && !strings.Contains(s, "://") {
+				res[i] = hostURL(c.GraphHost) + "/" + s
+			}
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+// scopeCovers tells if the granted scope includes need, a ReadWrite permission also allows reading
+func scopeCovers(granted, need string) bool {
+	granted = granted[strings.LastIndex(granted, "/")+1:]
+	return strings.EqualFold(granted, need) || strings.EqualFold(granted, strings.Replace(need, ".Read.", ".ReadWrite.", 1))
+}
+
+// missingScopes returns the permissions in need that are not covered by scopes
+func missingScopes(scopes, need []string) []string {
+	var missing []string
+	for _, n := range need {
+		found := false
+		for _, s := range scopes {
+			if scopeCovers(s, n) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, n)
+		}
+	}
+	return missing
+}
+
+// checkScopes warns if the configured or the granted scopes don't cover the enabled features
+func (o *oneManager) checkScopes() {
+	if o.conf.appOnly() {
+		// app-only tokens carry roles set by the admin consent, not scopes
+		return
+	}
+
+	need := o.conf.requiredScopes()
+	if missing := missingScopes(o.conf.scopes(), need); len(missing) > 0 {
+		log.Println("Warning: Scopes of", o.conf.ClientID, "don't include", strings.Join(missing, ", "))
+	}
+	if missing := missingScopes(o.conf.scopes(), []string{"offline_access"}); len(missing) > 0 {
+		log.Println("Warning: Scopes of", o.conf.ClientID, "don't include offline_access, the sign-in won't last beyond an hour")
+	}
+
+	t := o.tokens.Tokens()
+	if t.Access == "" || len(t.Scopes) == 0 {
+		return
+	}
+	if missing := missingScopes(t.Scopes, need); len(missing) > 0 {
+		log.Println("Warning: the token of", o.conf.ClientID, "is missing", strings.Join(missing, ", ")+", please sign in again")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie = "gone_session"
+	sessionTTL    = 7 * 24 * time.Hour
+)
+
+var sessionKey []byte
+
+// initSessions prepares the HMAC key of admin sessions, without SessionSecret
+// a random key is used and all sessions end when the server restarts
+func initSessions() {
+	if conf.SessionSecret != "" {
+		sessionKey = []byte(conf.SessionSecret)
+		return
+	}
+	sessionKey = make([]byte, 32)
+	rand.Read(sessionKey)
+}
+
+// checkPassword compares p with the configured password, which is either a bcrypt hash or plain text
+func checkPassword(p string) bool {
+	if strings.HasPrefix(conf.Password, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(conf.Password), []byte(p)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(conf.Password), []byte(p)) == 1
+}
+
+func signSession(expire int64) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("admin|" + strconv.FormatInt(expire, 10)))
+	return strconv.FormatInt(expire, 10) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func isAdmin(r *http.Request) bool {
+	c, _ := r.Cookie(sessionCookie)
+	if c == nil {
+		return false
+	}
+
+	expire, _ := strconv.ParseInt(c.Value[:strings.Index(c.Value+".", ".")], 10, 64)
+	if expire < time.Now().Unix() {
+		return false
+	}
+	return hmac.Equal([]byte(c.Value), []byte(signSession(expire)))
+}
+
+// secureCookie tells if cookies should be limited to HTTPS, gone is usually behind a TLS terminating proxy
+func secureCookie(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" || strings.HasPrefix(conf.RedirURL, "https://")
+}
+
+func setSession(w http.ResponseWriter, r *http.Request, value string, expire time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expire,
+		HttpOnly: true,
+		Secure:   secureCookie(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Login shows the admin login form and issues a session cookie for the right password
+func Login(w http.ResponseWriter, r *http.Request) {
+	msg := ""
+	if r.Method == "POST" {
+		if checkPassword(r.PostFormValue("password")) {
+			expire := time.Now().Add(sessionTTL)
+			setSession(w, r, signSession(expire.Unix()), expire)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		time.Sleep(time.Second)
+		w.WriteHeader(http.StatusUnauthorized)
+		msg = "Wrong password<hr>"
+	}
+
+	w.Write([]byte(`<html>
+		<head><meta charset="UTF-8"><title>Login</title></head>
+		<body bgcolor="white">
+		` + msg + `
+		<form method="POST" action="/?login">
+		<input type="password" name="password" autofocus>
+		<input type="submit" value="Login">
+		</form>
+		</body>
+		</html>
+		`))
+}
+
+func Logout(w http.ResponseWriter, r *http.Request) {
+	setSession(w, r, "", time.Unix(0, 0))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginLogout(t *testing.T) {
+	e := newTestEnv(t, nil)
+	defer e.Close()
+
+	c := e.client(false)
+	c.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	login := func(password string, h http.Header) *http.Response {
+		req, _ := http.NewRequest("POST", e.srv.URL+"/?login", strings.NewReader(url.Values{"password": {password}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	admin := func() bool {
+		req, _ := http.NewRequest("GET", e.srv.URL+"/", nil)
+		u, _ := url.Parse(e.srv.URL)
+		for _, cookie := range c.Jar.Cookies(u) {
+			req.AddCookie(cookie)
+		}
+		return isAdmin(req)
+	}
+
+	if resp := login("wrong", nil); resp.StatusCode != http.StatusUnauthorized || len(resp.Cookies()) != 0 || admin() {
+		t.Fatalf("a wrong password got %s and %d cookies", resp.Status, len(resp.Cookies()))
+	}
+
+	resp := login("test", nil)
+	if resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) != 1 || !admin() {
+		t.Fatalf("the password got %s and %d cookies", resp.Status, len(resp.Cookies()))
+	}
+	cookie := resp.Cookies()[0]
+	if cookie.Name != sessionCookie || cookie.Path != "/" || !cookie.HttpOnly || cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("got the session cookie %s", cookie)
+	}
+	if d := time.Until(cookie.Expires); d < sessionTTL-time.Minute || d > sessionTTL {
+		t.Fatalf("the session cookie expires in %s", d)
+	}
+	// behind a TLS terminating proxy the cookie is kept to HTTPS
+	if resp := login("test", http.Header{"X-Forwarded-Proto": {"https"}}); !resp.Cookies()[0].Secure {
+		t.Fatal("the session cookie is not Secure behind HTTPS")
+	}
+
+	resp, _ = e.get(t, c, "/?logout", nil)
+	if resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) != 1 || resp.Cookies()[0].Value != "" || admin() {
+		t.Fatalf("the logout got %s and %v", resp.Status, resp.Cookies())
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	for _, c := range []struct {
+		conf, password string
+		want           bool
+	}{
+		{"secret", "secret", true},
+		{"secret", "Secret", false},
+		{"secret", "", false},
+		{string(hash), "secret", true},
+		{string(hash), "wrong", false},
+		// a bcrypt hash is not a password of its own
+		{string(hash), string(hash), false},
+	} {
+		conf = &config{Password: c.conf}
+		if got := checkPassword(c.password); got != c.want {
+			t.Errorf("%q against %q: got %v", c.password, c.conf, got)
+		}
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	conf = &config{SessionSecret: "session-secret"}
+	initSessions()
+
+	valid := signSession(time.Now().Add(time.Hour).Unix())
+	expire := strconv.FormatInt(time.Now().Add(time.Hour).Unix()+60, 10)
+	tampered := []byte(valid)
+	tampered[len(tampered)-1] ^= 1
+	for _, c := range []struct {
+		value string
+		want  bool
+	}{
+		{valid, true},
+		{signSession(time.Now().Add(-time.Minute).Unix()), false},
+		{string(tampered), false},
+		// a later expiry with the signature of another
+		{expire + valid[strings.Index(valid, "."):], false},
+		{expire, false},
+		{"", false},
+		{"admin", false},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: c.value})
+		if got := isAdmin(req); got != c.want {
+			t.Errorf("%q: got %v", c.value, got)
+		}
+	}
+
+	// a session survives a restart with SessionSecret, and ends with a random key
+	initSessions()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: valid})
+	if !isAdmin(req) {
+		t.Fatal("the session has not survived a restart")
+	}
+	conf.SessionSecret = ""
+	initSessions()
+	if isAdmin(req) {
+		t.Fatal("the session has survived a new random key")
+	}
+}
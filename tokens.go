@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type tokens struct {
+	Access     string   `json:"access_token"`
+	Refresh    string   `json:"refresh_token"`
+	Refreshed  int64    `json:"refreshed"`
+	Expires    int64    `json:"expires,omitempty"`
+	ExtExpires int64    `json:"ext_expires,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+	// Public is set for tokens of a public client flow like the device code login, which are
+	// refreshed without the client secret or certificate
+	Public bool `json:"public,omitempty"`
+
+	// stale is set by Load if the stored format is outdated and should be saved again
+	stale bool
+}
+
+// TokenStore persists the OAuth tokens between restarts, Load returns os.ErrNotExist if nothing is stored
+type TokenStore interface {
+	Load() (*tokens, error)
+	Save(t *tokens) error
+}
+
+const encryptedTokenPrefix = "gone-aesgcm:"
+
+// fileTokenStore keeps tokens as JSON in a 0600 file, encrypted with AES-GCM if a key is given.
+// The legacy three-line format (refreshed, access, refresh) is still readable.
+type fileTokenStore struct {
+	path string
+	aead cipher.AEAD
+}
+
+// newFileTokenStore creates a store at path, the AES-256 key is derived from secret if it is not empty
+func newFileTokenStore(path, secret string) *fileTokenStore {
+	s := &fileTokenStore{path: path}
+	if secret != "" {
+		key := sha256.Sum256([]byte(secret))
+		block, _ := aes.NewCipher(key[:])
+		s.aead, _ = cipher.NewGCM(block)
+	}
+	return s
+}
+
+func (s *fileTokenStore) Load() (*tokens, error) {
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	str := strings.TrimSpace(string(buf))
+	switch {
+	case str == "":
+		return nil, os.ErrNotExist
+	case strings.HasPrefix(str, encryptedTokenPrefix):
+		if s.aead == nil {
+			return nil, fmt.Errorf("%s is encrypted, please specify the token key", s.path)
+		}
+		buf, err = base64.StdEncoding.DecodeString(str[len(encryptedTokenPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) < s.aead.NonceSize() {
+			return nil, fmt.Errorf("%s is corrupted", s.path)
+		}
+		buf, err = s.aead.Open(nil, buf[:s.aead.NonceSize()], buf[s.aead.NonceSize():], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %v", s.path, err)
+		}
+	case !strings.HasPrefix(str, "{"):
+		parts := strings.Split(str, "\n")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%s is corrupted", s.path)
+		}
+		t := &tokens{Access: parts[1], Refresh: parts[2], stale: true}
+		t.Refreshed, _ = strconv.ParseInt(parts[0], 10, 64)
+		return t, nil
+	}
+
+	t := &tokens{stale: s.aead != nil && !strings.HasPrefix(str, encryptedTokenPrefix)}
+	if err := json.Unmarshal(buf, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *fileTokenStore) Save(t *tokens) error {
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	if s.aead != nil {
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		buf = []byte(encryptedTokenPrefix + base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, buf, nil)))
+	}
+
+	return writeFileAtomic(s.path, buf, 0600)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gone-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.token")
+
+	// the legacy three-line file is read and marked for saving in the current format
+	if err := ioutil.WriteFile(path, []byte("1500000000\naccess-0\nrefresh-0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tk, err := newFileTokenStore(path, "").Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Refreshed != 1500000000 || tk.Access != "access-0" || tk.Refresh != "refresh-0" || !tk.stale {
+		t.Fatalf("got %+v from the legacy format", tk)
+	}
+
+	// saved encrypted, the file holds neither token and can only be read with the key
+	tk.Expires = 1500003600
+	if err := newFileTokenStore(path, "secret").Save(tk); err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadFile(path)
+	if !strings.HasPrefix(string(buf), encryptedTokenPrefix) || strings.Contains(string(buf), "refresh-0") {
+		t.Fatalf("the token file is not encrypted: %s", buf)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("the token file has mode %v, want 0600", info.Mode().Perm())
+	}
+
+	got, err := newFileTokenStore(path, "secret").Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Access != "access-0" || got.Refresh != "refresh-0" || got.Expires != 1500003600 || got.stale {
+		t.Fatalf("got %+v after the round trip", got)
+	}
+	if _, err := newFileTokenStore(path, "wrong").Load(); err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+		t.Fatalf("got %v with the wrong key", err)
+	}
+	if _, err := newFileTokenStore(path, "").Load(); err == nil || !strings.Contains(err.Error(), "please specify the token key") {
+		t.Fatalf("got %v without a key", err)
+	}
+
+	// a plain file is saved again encrypted once a key is configured
+	if err := newFileTokenStore(path, "").Save(got); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := newFileTokenStore(path, "secret").Load(); err != nil || !got.stale {
+		t.Fatalf("got %+v and %v for a plain file with a key", got, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.tmp-*")); len(files) != 0 {
+		t.Fatalf("temp files are left: %v", files)
+	}
+}
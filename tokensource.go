@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// refreshLimit is the assumed token lifetime when the token endpoint didn't tell
+	refreshLimit = 3550
+	maxBackoff   = 300
+)
+
+var (
+	errNotSignedIn   = errors.New("Server is not available yet")
+	errRefreshFailed = errors.New("Please try again later")
+)
+
+// expiry returns when the access token stops working, ext includes the extended
+// lifetime Azure AD grants during outages of the token service
+func (t *tokens) expiry(ext bool) int64 {
+	if ext && t.ExtExpires > t.Expires {
+		return t.ExtExpires
+	}
+	if t.Expires > 0 {
+		return t.Expires
+	}
+	return t.Refreshed + refreshLimit
+}
+
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// tokenSource hands out access tokens and refreshes them shortly before they expire,
+// concurrent callers share a single refresh
+type tokenSource struct {
+	mu        sync.Mutex
+	t         tokens
+	refreshAt int64
+	retryAt   int64
+	backoff   int64
+	call      *refreshCall
+	fetch     func(ctx context.Context, old tokens) (*tokens, error)
+	appOnly   bool
+	store     TokenStore
+	wake      chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// newTokenSource starts a token source, fetch exchanges the refresh token of the old tokens for new ones.
+// With appOnly fetch needs no refresh token, so tokens are available without any sign-in.
+func newTokenSource(store TokenStore, fetch func(ctx context.Context, old tokens) (*tokens, error), appOnly bool) *tokenSource {
+	ts := &tokenSource{
+		fetch:   fetch,
+		appOnly: appOnly,
+		store:   store,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go ts.run()
+	return ts
+}
+
+// set replaces the tokens, ts.mu must be held
+func (ts *tokenSource) set(t *tokens) {
+	ts.t = *t
+
+	// refresh 10% (at most 5 minutes) before the token expires, plus some jitter
+	// so that several instances sharing an app don't refresh all at once
+	exp := ts.t.expiry(false)
+	margin := (exp - ts.t.Refreshed) / 10
+	if margin > 300 {
+		margin = 300
+	}
+	if margin < 1 {
+		margin = 1
+	}
+	ts.refreshAt = exp - margin - rand.Int63n(margin/2+1)
+	ts.retryAt, ts.backoff = 0, 0
+}
+
+// renewable tells if new tokens can be fetched, ts.mu must be held
+func (ts *tokenSource) renewable() bool {
+	return ts.appOnly || ts.t.Refresh != ""
+}
+
+func (ts *tokenSource) save() {
+	if err := ts.store.Save(&ts.t); err != nil {
+		log.Println("Save tokens:", err)
+	}
+}
+
+// Load reads the stored tokens, stale formats are saved again in the current one
+func (ts *tokenSource) Load() error {
+	t, err := ts.store.Load()
+	if err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	ts.set(t)
+	if t.stale {
+		ts.save()
+	}
+	ts.mu.Unlock()
+	ts.poke()
+	return nil
+}
+
+// Set replaces the tokens with freshly granted ones and saves them
+func (ts *tokenSource) Set(t *tokens) {
+	ts.mu.Lock()
+	ts.set(t)
+	ts.save()
+	ts.mu.Unlock()
+	ts.poke()
+}
+
+// Tokens returns a copy of the current tokens
+func (ts *tokenSource) Tokens() tokens {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.t
+}
+
+// Invalidate marks access as rejected by Graph, so the next Token call waits for a new one.
+// Nothing happens if access has been replaced already.
+func (ts *tokenSource) Invalidate(access string) {
+	ts.mu.Lock()
+	if ts.t.Access == access {
+		now := time.Now().Unix()
+		ts.t.Expires, ts.t.ExtExpires = now, now
+		ts.refreshAt, ts.retryAt = 0, 0
+	}
+	ts.mu.Unlock()
+}
+
+// Token returns a valid access token. A token that is due for refresh but not
+// expired yet is returned at once while the refresh runs in the background.
+func (ts *tokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	access, now := ts.t.Access, time.Now().Unix()
+	if access == "" && !ts.appOnly {
+		ts.mu.Unlock()
+		return "", errNotSignedIn
+	}
+	if now < ts.refreshAt {
+		ts.mu.Unlock()
+		return access, nil
+	}
+
+	// the old token is still good until it expires, even if we failed to refresh it
+	usable := now < ts.t.expiry(true)
+	if now < ts.retryAt || !ts.renewable() {
+		ts.mu.Unlock()
+		if usable {
+			return access, nil
+		}
+		return "", errRefreshFailed
+	}
+
+	c := ts.startRefresh()
+	ts.mu.Unlock()
+	if usable {
+		return access, nil
+	}
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	if c.err != nil {
+		return "", errRefreshFailed
+	}
+	return ts.Tokens().Access, nil
+}
+
+// startRefresh returns the refresh in flight or starts a new one, ts.mu must be held.
+// The refresh is not bound to any caller's context, so one cancelled request doesn't fail it for all.
+func (ts *tokenSource) startRefresh() *refreshCall {
+	if ts.call != nil {
+		return ts.call
+	}
+
+	c := &refreshCall{done: make(chan struct{})}
+	ts.call = c
+	old := ts.t
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		start := time.Now()
+		t, err := ts.fetch(ctx, old)
+		cancel()
+		log.Println("Refresh token in", time.Now().Sub(start).Seconds(), "s")
+
+		ts.mu.Lock()
+		if err == nil {
+			ts.set(t)
+			ts.save()
+			log.Println("New token is OK at", time.Now(), "expires at", time.Unix(ts.t.Expires, 0))
+		} else {
+			ts.backoff *= 2
+			if ts.backoff < 5 {
+				ts.backoff = 5
+			} else if ts.backoff > maxBackoff {
+				ts.backoff = maxBackoff
+			}
+			ts.retryAt = time.Now().Unix() + ts.backoff
+			log.Println("Refresh token:", err, "retry in", ts.backoff, "s")
+		}
+		c.err = err
+		ts.call = nil
+		ts.mu.Unlock()
+		close(c.done)
+	}()
+	return c
+}
+
+func (ts *tokenSource) poke() {
+	select {
+	case ts.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run refreshes the tokens in time even if nobody asks for them, so an idle
+// server doesn't lose its refresh token
+func (ts *tokenSource) run() {
+	defer close(ts.stopped)
+	for {
+		ts.mu.Lock()
+		wait := time.Hour
+		if ts.renewable() {
+			next := ts.refreshAt
+			if ts.retryAt > next {
+				next = ts.retryAt
+			}
+			wait = time.Duration(next-time.Now().Unix()) * time.Second
+		}
+		ts.mu.Unlock()
+
+		if wait < time.Second {
+			wait = time.Second
+		}
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ts.stop:
+			timer.Stop()
+			return
+		case <-ts.wake:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		ts.mu.Lock()
+		var c *refreshCall
+		if now := time.Now().Unix(); ts.renewable() && now >= ts.refreshAt && now >= ts.retryAt {
+			c = ts.startRefresh()
+		}
+		ts.mu.Unlock()
+
+		if c != nil {
+			select {
+			case <-c.done:
+			case <-ts.stop:
+				return
+			}
+		}
+	}
+}
+
+// Close stops the background refresher
+func (ts *tokenSource) Close() {
+	ts.closeOnce.Do(func() { close(ts.stop) })
+	<-ts.stopped
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memTokenStore keeps the tokens in memory
+type memTokenStore struct {
+	mu sync.Mutex
+	t  *tokens
+}
+
+func (s *memTokenStore) Load() (*tokens, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.t == nil {
+		return nil, os.ErrNotExist
+	}
+	t := *s.t
+	return &t, nil
+}
+
+func (s *memTokenStore) Save(t *tokens) error {
+	s.mu.Lock()
+	c := *t
+	s.t = &c
+	s.mu.Unlock()
+	return nil
+}
+
+// expiredTokens have run out, so Token must wait for a refresh
+func expiredTokens() *tokens {
+	now := time.Now().Unix()
+	return &tokens{Access: "access-0", Refresh: "refresh-0", Refreshed: now - 3600, Expires: now - 10}
+}
+
+func TestTokenSourceSingleFlight(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	ts := newTokenSource(&memTokenStore{}, func(ctx context.Context, old tokens) (*tokens, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &tokens{Access: "access-1", Refresh: "refresh-1", Refreshed: time.Now().Unix(), Expires: time.Now().Unix() + 3600}, nil
+	}, false)
+	defer ts.Close()
+	ts.Set(expiredTokens())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if access, err := ts.Token(context.Background()); err != nil || access != "access-1" {
+				t.Errorf("got %q and %v, want the refreshed token", access, err)
+			}
+		}()
+	}
+	waitFor(t, "the refresh", func() bool { return atomic.LoadInt32(&calls) > 0 })
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("%d refreshes for concurrent callers, want 1", n)
+	}
+}
+
+func TestTokenSourceCancelledWaiter(t *testing.T) {
+	release := make(chan struct{})
+	ts := newTokenSource(&memTokenStore{}, func(ctx context.Context, old tokens) (*tokens, error) {
+		<-release
+		return &tokens{Access: "access-1", Refresh: "refresh-1", Refreshed: time.Now().Unix(), Expires: time.Now().Unix() + 3600}, nil
+	}, false)
+	defer ts.Close()
+	ts.Set(expiredTokens())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := ts.Token(ctx); err != context.Canceled {
+		t.Fatalf("got %v for a cancelled waiter", err)
+	}
+
+	// the refresh goes on for everybody else
+	close(release)
+	if access, err := ts.Token(context.Background()); err != nil || access != "access-1" {
+		t.Fatalf("got %q and %v after the cancelled waiter", access, err)
+	}
+}
+
+func TestTokenSourceBackoff(t *testing.T) {
+	var calls int32
+	ts := newTokenSource(&memTokenStore{}, func(ctx context.Context, old tokens) (*tokens, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("invalid_grant")
+	}, false)
+	defer ts.Close()
+	ts.Set(expiredTokens())
+
+	for i := 0; i < 3; i++ {
+		if _, err := ts.Token(context.Background()); err != errRefreshFailed {
+			t.Fatalf("got %v from a failed refresh", err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("%d refreshes within the backoff, want 1", n)
+	}
+
+	// the next failure after the backoff doubles it
+	ts.mu.Lock()
+	backoff := ts.backoff
+	ts.retryAt = 0
+	ts.mu.Unlock()
+	ts.Token(context.Background())
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if backoff != 5 || ts.backoff != 10 || ts.retryAt <= time.Now().Unix() {
+		t.Fatalf("backed off %ds and then %ds, want 5s and 10s", backoff, ts.backoff)
+	}
+}
+
+func TestTokenSourceClose(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	ts := newTokenSource(&memTokenStore{}, func(ctx context.Context, old tokens) (*tokens, error) {
+		close(started)
+		<-release
+		return nil, errors.New("closed")
+	}, false)
+	// nobody asks for a token, the refresher starts the refresh on its own
+	ts.Set(expiredTokens())
+	<-started
+
+	// Close doesn't wait for the refresh in flight, and may be called again
+	done := make(chan struct{})
+	go func() {
+		ts.Close()
+		ts.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close is blocked by a refresh")
+	}
+	select {
+	case <-ts.stopped:
+	default:
+		t.Fatal("the refresher is still running")
+	}
+}
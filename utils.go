@@ -2,9 +2,14 @@ package main
 
 import (
 	"bytes"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/russross/blackfriday"
 )
@@ -15,29 +20,106 @@ func (d *dummyWriter) Header() http.Header { return http.Header{} }
 
 func (d *dummyWriter) WriteHeader(statusCode int) {}
 
-func renderReadme(name string, values []*driveItem, r *http.Request) []byte {
+func renderReadme(m *mount, name string, values []*driveItem, r *http.Request) []byte {
+	// the readme is always wanted in full, drop any Range or conditional headers of the page request
+	r, _ = http.NewRequest("GET", r.URL.String(), nil)
+
 	switch strings.ToLower(name) {
 	case "readme.md":
 		dw := &dummyWriter{}
-		if serveFile(dw, r, name, values) {
+		if serveFile(dw, r, m, name, values) {
 			return blackfriday.MarkdownCommon(dw.Bytes())
 		}
 	case "readme.txt", "readme":
 		dw := &dummyWriter{}
 		dw.WriteString("<pre>")
-		if serveFile(dw, r, name, values) {
+		if serveFile(dw, r, m, name, values) {
 			dw.WriteString("</pre>")
 			return dw.Bytes()
 		}
 	case "readme.html", "readme.htm":
 		dw := &dummyWriter{}
-		if serveFile(dw, r, name, values) {
+		if serveFile(dw, r, m, name, values) {
 			return dw.Bytes()
 		}
 	}
 	return nil
 }
 
+// itemETag returns the quoted entity tag of item, or "" if it has none
+func itemETag(item *driveItem) string {
+	if item.ETag == "" {
+		return ""
+	}
+	if strings.HasPrefix(item.ETag, `"`) || strings.HasPrefix(item.ETag, `W/"`) {
+		return item.ETag
+	}
+	return strconv.Quote(item.ETag)
+}
+
+func itemModTime(item *driveItem) time.Time {
+	t, _ := time.Parse(time.RFC3339, item.LastModifiedDateTime)
+	return t
+}
+
+// etagMatch reports whether etag is in the comma separated list, weak comparison is used unless strong is set.
+// The tags are read up to their closing quote, as OneDrive's tags like "{id},1" have a comma inside.
+func etagMatch(list, etag string, strong bool) bool {
+	if etag == "" {
+		return false
+	}
+	for list = strings.TrimSpace(list); list != ""; list = strings.TrimLeft(list, ", \t") {
+		if list[0] == '*' {
+			return true
+		}
+		rest := strings.TrimPrefix(list, "W/")
+		if !strings.HasPrefix(rest, `"`) {
+			return false
+		}
+		end := strings.Index(rest[1:], `"`)
+		if end < 0 {
+			return false
+		}
+		n := len(list) - len(rest) + end + 2
+		t := list[:n]
+		list = list[n:]
+
+		if strong {
+			if t == etag && !strings.HasPrefix(t, "W/") {
+				return true
+			}
+		} else if strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether a conditional GET can be answered with 304 without touching the content
+func notModified(r *http.Request, etag string, modtime time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, etag, false)
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modtime.IsZero() && !modtime.Truncate(time.Second).After(ims)
+}
+
+// ifRange reports whether the Range header should be honored according to If-Range
+func ifRange(r *http.Request, etag string, modtime time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, `W/"`) {
+		return etagMatch(ir, etag, true)
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && !modtime.IsZero() && modtime.Truncate(time.Second).Equal(t)
+}
+
 func _orderAsc(b bool) bool { return b }
 
 func _orderDesc(b bool) bool { return !b }
@@ -87,3 +169,30 @@ func spaces(num int) string {
 	}
 	return strings.Repeat(" ", num)
 }
+
+// writeFileAtomic replaces fn with buf through a synced temporary file next to it,
+// so a crash leaves either the old or the new content but never half a file
+func writeFileAtomic(fn string, buf []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type davMultistatus struct {
+	XMLName   xml.Name `xml:"D:multistatus"`
+	NS        string   `xml:"xmlns:D,attr"`
+	Responses []davResponse
+}
+
+type davResponse struct {
+	XMLName  xml.Name `xml:"D:response"`
+	Href     string   `xml:"D:href"`
+	Propstat struct {
+		Prop struct {
+			DisplayName  string `xml:"D:displayname"`
+			ResourceType struct {
+				Collection *struct{} `xml:"D:collection"`
+			} `xml:"D:resourcetype"`
+			ContentLength int    `xml:"D:getcontentlength,omitempty"`
+			CreationDate  string `xml:"D:creationdate,omitempty"`
+			LastModified  string `xml:"D:getlastmodified,omitempty"`
+		} `xml:"D:prop"`
+		Status string `xml:"D:status"`
+	} `xml:"D:propstat"`
+}
+
+func davResponseOf(href string, item *driveItem) davResponse {
+	resp := davResponse{Href: (&url.URL{Path: href}).EscapedPath()}
+	prop := &resp.Propstat.Prop
+	prop.DisplayName = item.Name
+	prop.CreationDate = item.CreatedDateTime
+	if t, err := time.Parse(time.RFC3339, item.LastModifiedDateTime); err == nil {
+		prop.LastModified = t.UTC().Format(http.TimeFormat)
+	}
+	if item.Folder != nil {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		prop.ContentLength = item.Size
+	}
+	resp.Propstat.Status = "HTTP/1.1 200 OK"
+	return resp
+}
+
+// WebDAV serves a read-only view of the index under conf.WebDAVPrefix
+func WebDAV(w http.ResponseWriter, r *http.Request) {
+	admin := isAdmin(r)
+
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		return
+	case "PROPFIND", "GET", "HEAD":
+	default:
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := "/" + strings.Trim(strings.TrimPrefix(r.URL.Path, conf.WebDAVPrefix), "/")
+
+	// walk every segment so that items inside hidden folders stay hidden too
+	item := &driveItem{Folder: &_folder{}}
+	var values []*driveItem
+	var m *mount
+	if path != "/" {
+		parent := "/"
+		for _, name := range strings.Split(path[1:], "/") {
+			var x *driveItems
+			if m, x = listPath(r.Context(), parent); m.hidden(name) && !admin {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if x.Error.Message != "" {
+				http.Error(w, x.Error.Message, http.StatusBadGateway)
+				return
+			}
+
+			item = nil
+			for _, v := range x.Values {
+				if v.Name == name {
+					item, values = v, x.Values
+					break
+				}
+			}
+			if item == nil || (item.Folder == nil && parent+name != path) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			parent += name + "/"
+		}
+	}
+
+	href := conf.WebDAVPrefix + path
+	if item.Folder != nil && path != "/" {
+		href += "/"
+	}
+
+	if r.Method != "PROPFIND" {
+		if item.Folder != nil {
+			// collections have no content, their listing is a PROPFIND
+			w.Header().Set("Allow", "OPTIONS, PROPFIND")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if m.served(item.Name) {
+			serveFile(w, r, m, item.Name, values)
+		} else {
+			http.Redirect(w, r, m.backend.DownloadURL(item), http.StatusFound)
+		}
+		return
+	}
+
+	ms := &davMultistatus{NS: "DAV:"}
+	ms.Responses = append(ms.Responses, davResponseOf(href, item))
+
+	if item.Folder != nil && r.Header.Get("Depth") != "0" {
+		dir := strings.TrimSuffix(path, "/") + "/"
+		m, x := listPath(r.Context(), dir)
+		if x.Error.Message != "" {
+			http.Error(w, x.Error.Message, http.StatusBadGateway)
+			return
+		}
+
+		for _, v := range x.Values {
+			if m.hidden(v.Name) && !admin {
+				continue
+			}
+			h := conf.WebDAVPrefix + dir + v.Name
+			if v.Folder != nil {
+				h += "/"
+			}
+			ms.Responses = append(ms.Responses, davResponseOf(h, v))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(207)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(ms)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebDAV(t *testing.T) {
+	e := newTestEnv(t, func(c *config) {
+		c.WebDAVPrefix = "/dav"
+		c.Ignore = `^builds$`
+		c.Prefetch = `\.md$`
+	})
+	defer e.Close()
+	e.signIn(t)
+
+	propfind := func(c *http.Client, path, depth string) string {
+		req, _ := http.NewRequest("PROPFIND", e.srv.URL+path, nil)
+		req.Header.Set("Depth", depth)
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 207 {
+			return resp.Status
+		}
+		var ms struct {
+			Hrefs []string `xml:"response>href"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(ms.Hrefs, ",")
+	}
+
+	visitor, admin := e.client(false), e.client(true)
+	for _, c := range []struct {
+		c                 *http.Client
+		path, depth, want string
+	}{
+		{visitor, "/dav/", "1", "/dav/,/dav/docs/,/dav/readme.md"},
+		{admin, "/dav/", "1", "/dav/,/dav/builds/,/dav/docs/,/dav/readme.md"},
+		{visitor, "/dav/docs", "0", "/dav/docs/"},
+		{visitor, "/dav/docs/", "1", "/dav/docs/,/dav/docs/hello.txt"},
+		{visitor, "/dav/docs/hello.txt", "1", "/dav/docs/hello.txt"},
+		// items inside a hidden folder are as hidden as the folder
+		{visitor, "/dav/builds/", "1", "404 Not Found"},
+		{visitor, "/dav/builds/build-001.zip", "0", "404 Not Found"},
+		{admin, "/dav/builds/build-001.zip", "0", "/dav/builds/build-001.zip"},
+		{visitor, "/dav/nope.txt", "0", "404 Not Found"},
+	} {
+		if got := propfind(c.c, c.path, c.depth); got != c.want {
+			t.Errorf("PROPFIND %s at Depth %s: got %s, want %s", c.path, c.depth, got, c.want)
+		}
+	}
+
+	// prefetched files are served from the cache, the others are redirected to the drive
+	if _, body := e.get(t, visitor, "/dav/readme.md", nil); !strings.HasPrefix(body, "# Gone") {
+		t.Fatalf("got %q for the readme", body)
+	}
+	if files, _ := filepath.Glob("cache/*/*/*readme.md"); len(files) != 1 {
+		t.Fatalf("the readme has not been cached: %v", files)
+	}
+	noRedirect := e.client(false)
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, _ := e.get(t, noRedirect, "/dav/docs/hello.txt", nil)
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(resp.Header.Get("Location"), e.f.URL+"/download/") {
+		t.Fatalf("got %s to %s for hello.txt", resp.Status, resp.Header.Get("Location"))
+	}
+
+	// a collection has nothing to GET, and must not send the client out of the prefix
+	resp, _ = e.get(t, noRedirect, "/dav/docs/", nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Location") != "" {
+		t.Fatalf("got %s for a GET of a collection", resp.Status)
+	}
+}